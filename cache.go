@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// chunkCacheDir holds the vectors of embedded chunks keyed by the hash of
+// their text, caching is disabled when it is empty. It is only set with
+// CCRAG_CHUNK_CACHE=on, as nothing ever removes stale entries.
+var chunkCacheDir string
+
+// embedCacheKey returns the hash naming the cached embedding of input. It
+// covers the backend and its address along with the model, as the same
+// model name served elsewhere may produce other vectors.
+func embedCacheKey(input string) string {
+	address := ""
+	switch backendName {
+	case "ollama":
+		address = ollamaAddress
+	case "openai":
+		address = openAIAddress
+	}
+
+	sum := sha256.Sum256([]byte(backendName + "\x00" + address + "\x00" + vectorModel() + "\x00" + input))
+	return hex.EncodeToString(sum[:])
+}
+
+// chunkCachePath returns the cache file of the chunk embedded with the
+// current backend and embedding model. Files are spread over
+// subdirectories named by the first byte of the hash to keep directories
+// small.
+func chunkCachePath(input string) string {
+	name := embedCacheKey(input)
+	return filepath.Join(chunkCacheDir, name[:2], name+".json")
+}
+
+// readCachedVector returns the vector cached in path, nil when there is
+// none.
+func readCachedVector(path string) []float64 {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+
+	var vec []float64
+	if err := json.Unmarshal(data, &vec); err != nil || len(vec) == 0 {
+		return nil
+	}
+	return vec
+}
+
+// embedCached embeds the inputs like embedChunks, serving chunks embedded
+// before from the chunk cache so only new or edited chunks of a changed
+// file are sent to the server.
+func embedCached(ctx context.Context, inputs []string) ([][]float64, error) {
+	if chunkCacheDir == "" {
+		return embedChunks(ctx, inputs)
+	}
+
+	embeddings := make([][]float64, len(inputs))
+	missing := []int{}
+	for i, input := range inputs {
+		if vec := readCachedVector(chunkCachePath(input)); vec != nil {
+			embeddings[i] = vec
+			continue
+		}
+		missing = append(missing, i)
+	}
+
+	slog.Debug("chunk cache", "hits", len(inputs)-len(missing), "misses", len(missing))
+	if len(missing) == 0 {
+		return embeddings, nil
+	}
+
+	if err := embedMissing(ctx, inputs, embeddings, missing); err != nil {
+		return nil, err
+	}
+
+	// Cached vectors with another dimension than the fresh ones were made
+	// by another model under the same name, they are embedded again
+	dims := len(embeddings[missing[0]])
+	stale := []int{}
+	for i, vec := range embeddings {
+		if len(vec) != dims {
+			stale = append(stale, i)
+		}
+	}
+	if len(stale) > 0 {
+		slog.Warn("ignoring cached chunk embeddings of another dimension", "chunks", len(stale), "dims", dims)
+		if err := embedMissing(ctx, inputs, embeddings, stale); err != nil {
+			return nil, err
+		}
+	}
+
+	return embeddings, nil
+}
+
+// embedMissing embeds the inputs at the missing positions into embeddings
+// and caches their vectors.
+func embedMissing(ctx context.Context, inputs []string, embeddings [][]float64, missing []int) error {
+	missingInputs := make([]string, len(missing))
+	for k, i := range missing {
+		missingInputs[k] = inputs[i]
+	}
+
+	embedded, err := embedChunks(ctx, missingInputs)
+	if err != nil {
+		return err
+	}
+
+	for k, i := range missing {
+		embeddings[i] = embedded[k]
+
+		// The cache only saves time, failing to update it is not an error
+		path := chunkCachePath(inputs[i])
+		data, err := json.Marshal(embedded[k])
+		if err == nil {
+			err = os.MkdirAll(filepath.Dir(path), 0755)
+		}
+		if err == nil {
+			err = writeFileAtomic(path, data, 0644)
+		}
+		if err != nil {
+			slog.Debug("failed to cache chunk embedding", "err", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// readText returns the content of a text file as UTF-8. Files that aren't
+// valid UTF-8 are assumed to be Latin-1, the usual encoding of older notes,
+// and transcoded so they don't produce garbled chunks. Documents such as
+// PDF files are converted to text by their extractor.
+func readText(filename string) (string, error) {
+	if e, ok := extractorFor(filename); ok {
+		return e.extract(filename)
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+
+	if utf8.Valid(data) {
+		return strings.TrimPrefix(string(data), "\uFEFF"), nil
+	}
+
+	slog.Debug("transcoding from latin-1", "path", filename)
+
+	// Every Latin-1 byte is the code point of the same value
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		runes[i] = rune(b)
+	}
+	return string(runes), nil
+}
+
+// sentenceEnd matches sentence terminating punctuation, optionally followed
+// by closing quotes or brackets, and the whitespace after it.
+var sentenceEnd = regexp.MustCompile(`[.!?]+["')\]]*\s+`)
+
+// paragraphBreak matches one or more blank lines.
+var paragraphBreak = regexp.MustCompile(`\n\s*\n`)
+
+// headingLine matches org-mode and markdown heading lines.
+var headingLine = regexp.MustCompile(`^(\*+|#+)\s+\S`)
+
+// chunkFile splits the file into chunks of about size words each using the
+// given strategy. The words strategy cuts at exactly size words, sentences
+// and paragraphs keep whole sentences or paragraphs together and headings
+// makes a chunk of every org-mode or markdown section. A file of at most
+// size words is a single chunk whatever the strategy. A last chunk shorter
+// than minChunkWords is merged into the one before it.
+func chunkFile(filename string, size int, strategy string) ([]string, error) {
+	chunks, err := splitFile(filename, size, strategy)
+	if err != nil {
+		return nil, err
+	}
+
+	// Splitting a short note, say into a title line and its body, gives
+	// tiny chunks with noisy vectors while the whole note fits in one
+	if len(chunks) > 1 && countWords(chunks) <= size {
+		chunks = []string{strings.Join(chunks, "")}
+	}
+
+	return mergeShortTail(chunks, minChunkWords), nil
+}
+
+// countWords returns the total number of words in chunks.
+func countWords(chunks []string) int {
+	n := 0
+	for _, c := range chunks {
+		n += len(strings.Fields(c))
+	}
+	return n
+}
+
+func splitFile(filename string, size int, strategy string) ([]string, error) {
+	switch strategy {
+	case "", "words":
+		return readFileInChunks(filename, size)
+	case "sentences", "paragraphs", "headings":
+	default:
+		return nil, fmt.Errorf("unknown chunk strategy %q, expected words, sentences, paragraphs or headings", strategy)
+	}
+
+	text, err := readText(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	switch strategy {
+	case "sentences":
+		return groupUnits(splitSentences(text), size), nil
+	case "headings":
+		return chunkSections(text, size), nil
+	default:
+		return groupUnits(paragraphBreak.Split(text, -1), size), nil
+	}
+}
+
+// mergeShortTail appends the last chunk to the previous one when it has
+// fewer than minWords words, so stray trailing words don't get a low signal
+// embedding of their own. A file with a single chunk keeps it.
+func mergeShortTail(chunks []string, minWords int) []string {
+	n := len(chunks)
+	if n < 2 || len(strings.Fields(chunks[n-1])) >= minWords {
+		return chunks
+	}
+
+	chunks[n-2] += chunks[n-1]
+	return chunks[:n-1]
+}
+
+// orgTitle matches the title keyword of org-mode files.
+var orgTitle = regexp.MustCompile(`(?i)^#\+title:\s*(.*)$`)
+
+// metadataHeader returns a header naming the source file and its title, the
+// org-mode title keyword or else the first heading, to prepend to every
+// chunk before embedding it.
+func metadataHeader(filename string) string {
+	header := "source: " + filepath.Base(filename) + "\n"
+
+	text, err := readText(filename)
+	if err != nil {
+		return header
+	}
+
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if m := orgTitle.FindStringSubmatch(line); m != nil {
+			return header + "title: " + m[1] + "\n"
+		}
+		if headingLine.MatchString(line) {
+			return header + "title: " + strings.TrimSpace(strings.TrimLeft(line, "*#")) + "\n"
+		}
+	}
+
+	return header
+}
+
+// chunkSections makes a chunk of every section started by a heading line.
+// Sections longer than size words are split further and every piece starts
+// with the section heading so it keeps the context of the section.
+func chunkSections(text string, size int) []string {
+	type section struct {
+		heading []string
+		body    []string
+	}
+
+	sections := []section{{}}
+	for _, line := range strings.Split(text, "\n") {
+		if headingLine.MatchString(line) {
+			sections = append(sections, section{heading: strings.Fields(line)})
+			continue
+		}
+		last := &sections[len(sections)-1]
+		last.body = append(last.body, strings.Fields(line)...)
+	}
+
+	chunks := []string{}
+	for _, sec := range sections {
+		if len(sec.heading) == 0 && len(sec.body) == 0 {
+			continue
+		}
+
+		if len(sec.heading)+len(sec.body) <= size {
+			chunks = append(chunks, joinWords(sec.heading, sec.body))
+			continue
+		}
+
+		step := max(1, size-len(sec.heading))
+		for i := 0; i < len(sec.body); i += step {
+			chunks = append(chunks, joinWords(sec.heading, sec.body[i:min(i+step, len(sec.body))]))
+		}
+	}
+
+	return chunks
+}
+
+// joinWords joins all words the same way readFileInChunks does.
+func joinWords(parts ...[]string) string {
+	var b strings.Builder
+	for _, words := range parts {
+		for _, w := range words {
+			b.WriteString(w + " ")
+		}
+	}
+	return b.String()
+}
+
+// splitSentences splits text after sentence terminating punctuation that is
+// followed by whitespace and a capital letter or digit.
+func splitSentences(text string) []string {
+	sentences := []string{}
+	start := 0
+	for _, m := range sentenceEnd.FindAllStringIndex(text, -1) {
+		// Abbreviations like "e.g. this" are not followed by a capital
+		next, size := utf8.DecodeRuneInString(text[m[1]:])
+		if size > 0 && !unicode.IsUpper(next) && !unicode.IsDigit(next) {
+			continue
+		}
+
+		sentences = append(sentences, text[start:m[1]])
+		start = m[1]
+	}
+
+	if start < len(text) {
+		sentences = append(sentences, text[start:])
+	}
+
+	return sentences
+}
+
+// groupUnits joins consecutive units, such as sentences or paragraphs, into
+// chunks of at most size words. Units are never split, so a unit longer
+// than size becomes a chunk of its own. Whitespace is collapsed the same
+// way as by readFileInChunks.
+func groupUnits(units []string, size int) []string {
+	chunks := []string{}
+
+	var wordCount int
+	var currentChunk strings.Builder
+
+	for _, unit := range units {
+		words := strings.Fields(unit)
+		if len(words) == 0 {
+			continue
+		}
+
+		if wordCount > 0 && wordCount+len(words) > size {
+			chunks = append(chunks, currentChunk.String())
+			currentChunk.Reset()
+			wordCount = 0
+		}
+
+		for _, w := range words {
+			currentChunk.WriteString(w + " ")
+		}
+		wordCount += len(words)
+	}
+
+	if currentChunk.Len() > 0 {
+		chunks = append(chunks, currentChunk.String())
+	}
+
+	return chunks
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestReadFileInChunks(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		size int
+		want []string
+	}{
+		{"empty", "", 3, []string{}},
+		{"shorter than a chunk", "one two", 3, []string{"one two "}},
+		{"exactly one chunk", "one two three", 3, []string{"one two three "}},
+		{"chunk boundary", "one two three four five six", 3, []string{"one two three ", "four five six "}},
+		{"trailing chunk", "one two three four", 3, []string{"one two three ", "four "}},
+		{"whitespace collapsed", "one\n\ttwo   three\n\nfour", 2, []string{"one two ", "three four "}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "note.txt")
+			if err := os.WriteFile(path, []byte(tt.text), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := readFileInChunks(path, tt.size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("readFileInChunks(%q, %d) = %q, want %q", tt.text, tt.size, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitSentences(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want []string
+	}{
+		{"single", "Only one.", []string{"Only one."}},
+		{"two", "First one. Second one.", []string{"First one. ", "Second one."}},
+		{"abbreviation", "See e.g. this one. Next.", []string{"See e.g. this one. ", "Next."}},
+		{"digit", "Items follow. 2 more.", []string{"Items follow. ", "2 more."}},
+		{"non ascii", "Première phrase. Été suivant.", []string{"Première phrase. ", "Été suivant."}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := splitSentences(tt.text); !slices.Equal(got, tt.want) {
+				t.Errorf("splitSentences(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// applyConfigFile loads a JSON object of settings from path and exports
+// every entry missing from the environment as its CCRAG_* variable. Keys
+// are the variable names without the prefix in any case, for example
+// "embed_model" sets CCRAG_EMBED_MODEL. A missing file is not an error.
+func applyConfigFile(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	decoder := json.NewDecoder(f)
+	decoder.UseNumber()
+
+	var config map[string]any
+	if err := decoder.Decode(&config); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	for key, value := range config {
+		switch value.(type) {
+		case string, json.Number, bool:
+		default:
+			return fmt.Errorf("%s: value of %q must be a string, number or boolean", path, key)
+		}
+
+		name := "CCRAG_" + strings.ToUpper(key)
+		if _, ok := os.LookupEnv(name); ok {
+			continue
+		}
+
+		if err := os.Setenv(name, fmt.Sprint(value)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
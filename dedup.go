@@ -0,0 +1,79 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	ix "github.com/kif11/rag/pkg/index"
+)
+
+// similarPair is a pair of indexed files that are likely near duplicates.
+type similarPair struct {
+	Score float64
+	A, B  string
+}
+
+// fileVector returns the mean of the unit length chunk vectors of a file,
+// scaled to unit length itself.
+func fileVector(f EmbeddingFile) []float64 {
+	mean := make([]float64, len(f.Vector(0)))
+	for k := range f.Len() {
+		for i, x := range ix.Normalize(f.Vector(k)) {
+			mean[i] += x
+		}
+	}
+	return ix.Normalize(mean)
+}
+
+// fileSimilarity compares two files the way queries score them, by their
+// averaged chunk vectors or, with the max score mode, by their best
+// matching pair of chunks.
+func fileSimilarity(a, b EmbeddingFile, vecA, vecB []float64) float64 {
+	if scoreMode != "max" {
+		return ix.DotProduct(vecA, vecB)
+	}
+
+	var best float64
+	for i := range a.Len() {
+		for j := range b.Len() {
+			best = max(best, ix.CosineSimilarity(a.Vector(i), b.Vector(j)))
+		}
+	}
+	return best
+}
+
+// dedupReport prints every pair of indexed files at least threshold
+// similar to each other, most similar first.
+func dedupReport(index []EmbeddingFile, threshold float64) {
+	vecs := make([][]float64, len(index))
+	for i, f := range index {
+		vecs[i] = fileVector(f)
+	}
+
+	pairs := []similarPair{}
+	for i := range index {
+		for j := i + 1; j < len(index); j++ {
+			if len(vecs[i]) != len(vecs[j]) {
+				slog.Debug("skipping files of different dimensions", "a", index[i].Source, "b", index[j].Source)
+				continue
+			}
+
+			score := fileSimilarity(index[i], index[j], vecs[i], vecs[j])
+			if score >= threshold {
+				pairs = append(pairs, similarPair{Score: score, A: index[i].Source, B: index[j].Source})
+			}
+		}
+	}
+
+	slices.SortFunc(pairs, func(a, b similarPair) int {
+		return cmp.Or(cmp.Compare(b.Score, a.Score), strings.Compare(a.A, b.A), strings.Compare(a.B, b.B))
+	})
+
+	for _, p := range pairs {
+		fmt.Printf("%.4f\t%s\t%s\n", p.Score, p.A, p.B)
+	}
+	slog.Debug("dedup report", "files", len(index), "pairs", len(pairs), "threshold", threshold)
+}
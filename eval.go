@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// evalCase is a query along with the sources a good search finds for it.
+type evalCase struct {
+	Query           string   `json:"query"`
+	ExpectedSources []string `json:"expected_sources"`
+}
+
+// readEvalCases reads a JSON list of evaluation cases from path.
+func readEvalCases(path string) ([]evalCase, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cases []evalCase
+	if err := json.Unmarshal(data, &cases); err != nil {
+		return nil, fmt.Errorf("invalid eval file %s, %w", path, err)
+	}
+
+	for i, c := range cases {
+		if c.Query == "" || len(c.ExpectedSources) == 0 {
+			return nil, fmt.Errorf("eval case %d needs a query and expected_sources", i)
+		}
+	}
+	return cases, nil
+}
+
+// runEval searches the index for the query of every case and prints the
+// precision and recall of the k files found and the reciprocal rank of the
+// first expected one, then their means over all cases.
+func runEval(ctx context.Context, index []EmbeddingFile, path string, k int) error {
+	cases, err := readEvalCases(path)
+	if err != nil {
+		return err
+	}
+
+	var sumPrecision, sumRecall, sumRR float64
+	for _, c := range cases {
+		queryVec, err := embedQuery(ctx, c.Query)
+		if err != nil {
+			return err
+		}
+
+		expected := map[string]bool{}
+		for _, s := range c.ExpectedSources {
+			expected[filepath.Clean(s)] = true
+		}
+
+		// Files can be found once per chunk, only their first rank counts
+		found := map[string]bool{}
+		hits, rank := 0, 0
+		var rr float64
+		for _, r := range retrieve(ctx, index, c.Query, queryVec, k) {
+			p := filepath.Clean(r.Path)
+			if found[p] {
+				continue
+			}
+			found[p] = true
+			rank++
+
+			if expected[p] {
+				hits++
+				if rr == 0 {
+					rr = 1 / float64(rank)
+				}
+			}
+		}
+
+		precision := float64(hits) / float64(k)
+		recall := float64(hits) / float64(len(expected))
+		fmt.Printf("%.3f\t%.3f\t%.3f\t%s\n", precision, recall, rr, c.Query)
+
+		sumPrecision += precision
+		sumRecall += recall
+		sumRR += rr
+	}
+
+	n := float64(len(cases))
+	fmt.Printf("Cases: %d\n", len(cases))
+	if n > 0 {
+		fmt.Printf("Precision@%d: %.3f\n", k, sumPrecision/n)
+		fmt.Printf("Recall@%d: %.3f\n", k, sumRecall/n)
+		fmt.Printf("MRR: %.3f\n", sumRR/n)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// explainSnippetWords is the number of words of the best matching chunk
+// shown by -explain.
+const explainSnippetWords = 30
+
+// printExplanation prints why every result was selected, its score, the
+// position of its best matching chunk and the start of that chunk.
+func printExplanation(results []ScoredResult) {
+	for i, r := range results {
+		fmt.Printf("%d. %f\t%s\tchunk %d\n", i+1, r.Score, r.Path, r.Chunk)
+		if snippet := chunkSnippet(r); snippet != "" {
+			fmt.Printf("   %s\n", snippet)
+		}
+	}
+}
+
+// chunkSnippet returns the first explainSnippetWords words of the best
+// matching chunk of the result. The chunk is read from the source when its
+// text wasn't stored with the embeddings.
+func chunkSnippet(r ScoredResult) string {
+	text := r.Text
+	if text == "" {
+		var err error
+		text, err = bestChunk(r)
+		if err != nil {
+			slog.Warn("failed to read best chunk", "path", r.Path, "err", err)
+			return ""
+		}
+	}
+
+	words := strings.Fields(text)
+	if len(words) > explainSnippetWords {
+		return strings.Join(words[:explainSnippetWords], " ") + " ..."
+	}
+	return strings.Join(words, " ")
+}
+
+// bestChunk reads the best matching chunk of the result from its source, the
+// whole source for results that weren't chunked such as -context files.
+func bestChunk(r ScoredResult) (string, error) {
+	if r.ChunkSize <= 0 {
+		return readText(r.Path)
+	}
+
+	chunks, err := chunkFile(r.Path, r.ChunkSize, r.ChunkStrategy)
+	if err != nil {
+		return "", err
+	}
+	if r.Chunk >= len(chunks) {
+		return "", fmt.Errorf("chunk %d not found, the source changed since it was embedded", r.Chunk)
+	}
+	return chunks[r.Chunk], nil
+}
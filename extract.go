@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// extractor converts a file that isn't plain text into text.
+type extractor struct {
+	// tool is the external program the extractor runs, it must be on PATH
+	tool    string
+	extract func(filename string) (string, error)
+}
+
+// extractors are keyed by lower case file extension.
+var extractors = map[string]extractor{
+	".pdf": {tool: "pdftotext", extract: extractPDF},
+}
+
+// extractorFor returns the extractor for the file, if there is one for its
+// extension.
+func extractorFor(filename string) (extractor, bool) {
+	e, ok := extractors[strings.ToLower(filepath.Ext(filename))]
+	return e, ok
+}
+
+// checkExtractor reports why the file can't be extracted, nil when the
+// tool the extractor needs is installed.
+func checkExtractor(e extractor) error {
+	if _, err := exec.LookPath(e.tool); err != nil {
+		return fmt.Errorf("%s is needed to read this file type but was not found", e.tool)
+	}
+	return nil
+}
+
+// extractPDF returns the text of a PDF file using pdftotext from poppler.
+func extractPDF(filename string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("pdftotext", "-enc", "UTF-8", filename, "-")
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("pdftotext failed on %s, %w: %s", filename, err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// queryTerms returns the distinct lower case words of the query.
+func queryTerms(query string) []string {
+	terms := []string{}
+	seen := map[string]bool{}
+	for _, t := range tokenize(query) {
+		if !seen[t] {
+			seen[t] = true
+			terms = append(terms, t)
+		}
+	}
+	return terms
+}
+
+// tokenize splits text into lower case words made of letters and digits, so
+// identifiers like error codes survive punctuation around them.
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// keywordScore returns the fraction of the query terms found in text.
+func keywordScore(terms []string, text string) float64 {
+	if len(terms) == 0 {
+		return 0
+	}
+
+	words := map[string]bool{}
+	for _, w := range tokenize(text) {
+		words[w] = true
+	}
+
+	found := 0
+	for _, t := range terms {
+		if words[t] {
+			found++
+		}
+	}
+	return float64(found) / float64(len(terms))
+}
+
+// hybridScore wraps the vector score of the file chunks, blending it with
+// the keyword score of the chunk text according to hybridAlpha. Unless the
+// chunk text is stored it is re-chunked from the source, chunks that can't
+// be read only get their vector score weighted.
+func hybridScore(embNote EmbeddingFile, terms []string, vector func(i int) float64) func(i int) float64 {
+	chunkText := func(i int) (string, bool) {
+		return embNote.Chunks[i], true
+	}
+	if len(embNote.Chunks) != embNote.Len() {
+		texts, _ := chunkFile(embNote.Source, embNote.ChunkSize, embNote.ChunkStrategy)
+		chunkText = func(i int) (string, bool) {
+			if p := embNote.ChunkPosition(i); p < len(texts) {
+				return texts[p], true
+			}
+			return "", false
+		}
+	}
+
+	return func(i int) float64 {
+		var keyword float64
+		if text, ok := chunkText(i); ok {
+			keyword = keywordScore(terms, text)
+		}
+		return (1-hybridAlpha)*vector(i) + hybridAlpha*keyword
+	}
+}
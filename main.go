@@ -3,20 +3,30 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"log"
-	"math"
+	"io/fs"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
 
 	cc "github.com/kif11/cclib"
+	ix "github.com/kif11/rag/pkg/index"
 )
 
 type EmbeddingResponse struct {
@@ -27,15 +37,44 @@ type EmbeddingResponse struct {
 	PromptEvalCount int         `json:"prompt_eval_count"`
 }
 
-type EmbeddingFile struct {
-	Embeddings [][]float64 `json:"embeddings"`
-	ChunkSize  int         `json:"chunk_size"`
-	Source     string      `json:"source"`
+// EmbeddingFile and ScoredResult are defined by the index package so other
+// programs can search an index too.
+type (
+	EmbeddingFile = ix.EmbeddingFile
+	ScoredResult  = ix.ScoredResult
+)
+
+// chunkSet records hashes of chunk texts embedded during this run.
+type chunkSet struct {
+	mu   sync.Mutex
+	seen map[[sha256.Size]byte]bool
+}
+
+func newChunkSet() *chunkSet {
+	return &chunkSet{seen: map[[sha256.Size]byte]bool{}}
+}
+
+// add records the chunk and reports whether it wasn't seen before.
+func (s *chunkSet) add(chunk string) bool {
+	h := sha256.Sum256([]byte(chunk))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.seen[h] {
+		return false
+	}
+	s.seen[h] = true
+	return true
 }
 
-type ScoredResult struct {
-	Score float64
-	Path  string
+// GenerateOptions are optional LLM generation parameters. Unset fields are
+// left out of the request so the server defaults apply.
+type GenerateOptions struct {
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
+	NumPredict  *int     `json:"num_predict,omitempty"`
+	Seed        *int     `json:"seed,omitempty"`
 }
 
 type OllamaResponse struct {
@@ -51,347 +90,2029 @@ type OllamaResponse struct {
 	PromptEvalDuration int64  `json:"prompt_eval_duration"`
 	EvalCount          int    `json:"eval_count"`
 	EvalDuration       int64  `json:"eval_duration"`
+	// Error is set instead of the response when generation failed, also
+	// midway through a stream.
+	Error string `json:"error,omitempty"`
+}
+
+// Settings, populated from the environment by loadSettings
+var (
+	ollamaAddress      string
+	embedModel         string
+	llmModel           string
+	maxResults         int
+	chunkSize          int
+	chunkStrategy      string
+	minScore           float64
+	scoreMode          string
+	contextMode        string
+	backendName        string
+	genOptions         GenerateOptions
+	promptTemplateText string
+	promptFile         string
+	embedRetries       int
+	embedWorkers       int
+	embedBatch         int
+	maxFileBytes       int
+	includeGlob        string
+	openAIAddress      string
+	apiKey             string
+	embedFormat        string
+	storeKind          string
+	naming             string
+	collection         string
+	httpTimeout        time.Duration
+	caFile             string
+	clientCert         string
+	clientKey          string
+	tlsInsecure        bool
+	queryCache         string
+	chunkCache         string
+	verboseLevel       int
+	minChunkWords      int
+	minFileWords       int
+	embedCompress      bool
+	contextWindow      int
+	hybridAlpha        float64
+	dedupThreshold     float64
+	rerank             bool
+	rerankCandidates   int
+	maxContextWords    int
+	sessionFile        string
+	maxChunksPerFile   int
+	storeChunks        bool
+	quantize           string
+	indexKind          string
+	retrievalUnit      string
+	metric             string
+	annProbes          int
+	embedMetadata      bool
+)
+
+var embedDirName = "embed"
+
+// loadSettings reads all settings from CCRAG_* environment variables,
+// falling back to defaults for unset ones.
+func loadSettings() {
+	ollamaAddress = cc.GetEnv("CCRAG_OLLAMA_ADDRESS", "http://localhost:11434")
+	embedModel = cc.GetEnv("CCRAG_EMBED_MODEL", "mxbai-embed-large")
+	llmModel = cc.GetEnv("CCRAG_LLM_MODEL", "mistral:latest")
+	maxResults = cc.GetEnvInt("CCRAG_MAX_RESULTS", 10)
+	chunkSize = cc.GetEnvInt("CCRAG_WORDS_PER_CHUNK", 100)
+	chunkStrategy = cc.GetEnv("CCRAG_CHUNK_STRATEGY", "words")
+	minChunkWords = cc.GetEnvInt("CCRAG_MIN_CHUNK_WORDS", 0)
+	minFileWords = cc.GetEnvInt("CCRAG_MIN_FILE_WORDS", 5)
+	maxChunksPerFile = cc.GetEnvInt("CCRAG_MAX_CHUNKS_PER_FILE", 0)
+	embedMetadata = cc.GetEnv("CCRAG_EMBED_METADATA", "false") == "true"
+	storeChunks = cc.GetEnv("CCRAG_STORE_CHUNKS", "false") == "true"
+	quantize = cc.GetEnv("CCRAG_QUANTIZE", "")
+	indexKind = cc.GetEnv("CCRAG_INDEX", "exact")
+	retrievalUnit = cc.GetEnv("CCRAG_RETRIEVAL_UNIT", "file")
+	metric = cc.GetEnv("CCRAG_METRIC", "cosine")
+	annProbes = cc.GetEnvInt("CCRAG_ANN_PROBES", 8)
+	minScore = getEnvFloat("CCRAG_MIN_SCORE", 0.0)
+	scoreMode = cc.GetEnv("CCRAG_SCORE_MODE", "mean")
+	hybridAlpha = getEnvFloat("CCRAG_HYBRID_ALPHA", 0)
+	dedupThreshold = getEnvFloat("CCRAG_DEDUP_THRESHOLD", 0.95)
+	rerank = cc.GetEnv("CCRAG_RERANK", "false") == "true"
+	rerankCandidates = cc.GetEnvInt("CCRAG_RERANK_CANDIDATES", 20)
+	contextMode = cc.GetEnv("CCRAG_CONTEXT_MODE", "chunk")
+	contextWindow = cc.GetEnvInt("CCRAG_CONTEXT_WINDOW", 0)
+	maxContextWords = cc.GetEnvInt("CCRAG_MAX_CONTEXT_WORDS", 0)
+	sessionFile = cc.GetEnv("CCRAG_SESSION", "")
+	backendName = cc.GetEnv("CCRAG_BACKEND", "ollama")
+	genOptions = GenerateOptions{
+		Temperature: getEnvFloatPtr("CCRAG_TEMPERATURE"),
+		TopP:        getEnvFloatPtr("CCRAG_TOP_P"),
+		NumPredict:  getEnvIntPtr("CCRAG_NUM_PREDICT"),
+		Seed:        getEnvIntPtr("CCRAG_SEED"),
+	}
+	promptTemplateText = cc.GetEnv("CCRAG_PROMPT_TEMPLATE", "")
+	promptFile = cc.GetEnv("CCRAG_PROMPT_FILE", "")
+	embedRetries = cc.GetEnvInt("CCRAG_EMBED_RETRIES", 3)
+	embedWorkers = cc.GetEnvInt("CCRAG_EMBED_WORKERS", 4)
+	embedBatch = cc.GetEnvInt("CCRAG_EMBED_BATCH", 32)
+	maxFileBytes = cc.GetEnvInt("CCRAG_MAX_FILE_BYTES", 10*1024*1024)
+	includeGlob = cc.GetEnv("CCRAG_INCLUDE_GLOB", "*.org,*.md,*.txt")
+	openAIAddress = cc.GetEnv("CCRAG_OPENAI_ADDRESS", "https://api.openai.com")
+	apiKey = cc.GetEnv("CCRAG_API_KEY", "")
+	embedFormat = cc.GetEnv("CCRAG_EMBED_FORMAT", "json")
+	embedCompress = cc.GetEnv("CCRAG_EMBED_COMPRESS", "false") == "true"
+	storeKind = cc.GetEnv("CCRAG_STORE", "file")
+	naming = cc.GetEnv("CCRAG_NAMING", "fullpath-hash")
+	collection = cc.GetEnv("CCRAG_COLLECTION", "default")
+	httpTimeout = getEnvDuration("CCRAG_HTTP_TIMEOUT", 3*time.Minute)
+	caFile = cc.GetEnv("CCRAG_CA_FILE", "")
+	clientCert = cc.GetEnv("CCRAG_CLIENT_CERT", "")
+	clientKey = cc.GetEnv("CCRAG_CLIENT_KEY", "")
+	tlsInsecure = cc.GetEnv("CCRAG_TLS_INSECURE", "false") == "true"
+	queryCache = cc.GetEnv("CCRAG_QUERY_CACHE", "on")
+	chunkCache = cc.GetEnv("CCRAG_CHUNK_CACHE", "off")
+	verboseLevel = cc.GetEnvInt("CCRAG_VERBOSE", 0)
+}
+
+// checkSettings rejects numeric settings outside of their valid range,
+// which would otherwise misbehave in subtle ways far from their cause.
+func checkSettings() error {
+	atLeast := []struct {
+		name  string
+		value int
+		min   int
+	}{
+		{"CCRAG_MAX_RESULTS or -n", maxResults, 1},
+		{"CCRAG_WORDS_PER_CHUNK", chunkSize, 1},
+		{"CCRAG_MIN_CHUNK_WORDS", minChunkWords, 0},
+		{"CCRAG_MIN_FILE_WORDS", minFileWords, 0},
+		{"CCRAG_MAX_CHUNKS_PER_FILE", maxChunksPerFile, 0},
+		{"CCRAG_EMBED_WORKERS", embedWorkers, 1},
+		{"CCRAG_EMBED_BATCH", embedBatch, 0},
+		{"CCRAG_EMBED_RETRIES", embedRetries, 0},
+		{"CCRAG_MAX_FILE_BYTES", maxFileBytes, 0},
+		{"CCRAG_CONTEXT_WINDOW", contextWindow, 0},
+		{"CCRAG_MAX_CONTEXT_WORDS", maxContextWords, 0},
+		{"CCRAG_RERANK_CANDIDATES", rerankCandidates, 1},
+		{"CCRAG_ANN_PROBES", annProbes, 1},
+	}
+	for _, s := range atLeast {
+		if s.value < s.min {
+			return fmt.Errorf("%s must be at least %d, got %d", s.name, s.min, s.value)
+		}
+	}
+
+	if hybridAlpha < 0 || hybridAlpha > 1 {
+		return fmt.Errorf("CCRAG_HYBRID_ALPHA must be between 0 and 1, got %v", hybridAlpha)
+	}
+	if quantize != "" && quantize != "int8" {
+		return fmt.Errorf("unknown quantization %q, expected int8", quantize)
+	}
+	if indexKind != "exact" && indexKind != "ann" {
+		return fmt.Errorf("unknown CCRAG_INDEX %q, expected exact or ann", indexKind)
+	}
+	if retrievalUnit != "file" && retrievalUnit != "chunk" {
+		return fmt.Errorf("unknown CCRAG_RETRIEVAL_UNIT %q, expected file or chunk", retrievalUnit)
+	}
+	if metric != "cosine" && metric != "dot" && metric != "euclidean" {
+		return fmt.Errorf("unknown CCRAG_METRIC %q, expected cosine, dot or euclidean", metric)
+	}
+	if httpTimeout < 0 {
+		return fmt.Errorf("CCRAG_HTTP_TIMEOUT must not be negative, got %s", httpTimeout)
+	}
+
+	return nil
+}
+
+// checkCollection reports whether name can be used as a collection name,
+// which becomes a directory inside the embed directory.
+func checkCollection(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid collection name %q", name)
+	}
+	return nil
+}
+
+var client = newHTTPClient(3*time.Minute, 2, nil)
+
+// newHTTPClient returns a client giving up on requests after timeout, zero
+// means no timeout. Up to conns idle connections per host are kept alive
+// so concurrent embed workers don't pay the connection setup per request.
+// A nil tlsConf keeps the default TLS settings.
+func newHTTPClient(timeout time.Duration, conns int, tlsConf *tls.Config) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = max(conns, 2)
+	if tlsConf != nil {
+		transport.TLSClientConfig = tlsConf
+	}
+
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+	}
+}
+
+// closeBody drains and closes a response body, which lets the transport
+// reuse the connection for the next request.
+func closeBody(body io.ReadCloser) {
+	io.Copy(io.Discard, body)
+	body.Close()
+}
+
+var backend Backend
+var store Store
+
+// globalChunks is set when duplicate chunks should be skipped across all
+// files embedded in this run, not only within a single file.
+var globalChunks *chunkSet
+
+// forceEmbed is set when sources should be embedded again even if their
+// stored embeddings are up to date.
+var forceEmbed bool
+var promptTemplate *template.Template
+
+// errUpToDate is returned by embedPath when the source does not need to be
+// embedded again.
+var errUpToDate = errors.New("embedding is up to date")
+
+// errSkipped is returned by embedPath, wrapped with the reason, when the
+// source is not suitable for embedding.
+var errSkipped = errors.New("skipped")
+
+// Exit codes
+const (
+	exitError     = 1
+	exitNoResults = 2
+)
+
+// terminal serializes everything written to stderr by concurrent workers,
+// log lines and the progress line alike, so every write stays whole.
+type terminal struct {
+	mu sync.Mutex
+	w  io.Writer
+	// partial is set while the last write didn't end its line, like the
+	// progress line which is redrawn in place
+	partial bool
+}
+
+func (t *terminal) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Start a new line instead of gluing a log line to the progress line
+	if t.partial && !bytes.HasPrefix(p, []byte("\r")) && !bytes.HasPrefix(p, []byte("\n")) {
+		if _, err := t.w.Write([]byte("\n")); err != nil {
+			return 0, err
+		}
+	}
+	t.partial = len(p) > 0 && !bytes.HasSuffix(p, []byte("\n"))
+
+	return t.w.Write(p)
+}
+
+// stderr is where diagnostics and progress are written.
+var stderr = &terminal{w: os.Stderr}
+
+// setupLogging sends diagnostics to stderr, keeping stdout for results.
+// Debug messages are only shown in verbose mode.
+func setupLogging(verbose bool) {
+	level := slog.LevelInfo
+	if verbose {
+		level = slog.LevelDebug
+	}
+
+	handler := slog.NewTextHandler(stderr, &slog.HandlerOptions{
+		Level: level,
+		// Timestamps are noise for a command line tool
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})
+	slog.SetDefault(slog.New(handler))
+}
+
+// fatal logs msg as an error and exits with exitError.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(exitError)
+}
+
+// loadQueryIndex loads the index for modes answering queries. It exits
+// with a hint when nothing usable was embedded yet instead of failing
+// every query.
+func loadQueryIndex() []EmbeddingFile {
+	index, err := loadIndex()
+	if err != nil {
+		fatal(err.Error())
+	}
+	if len(index) == 0 {
+		slog.Warn("no embeddings found, run ccrag -e first", "collection", collection)
+		os.Exit(exitNoResults)
+	}
+	return index
+}
+
+// usage prints the flag defaults followed by the exit codes.
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage of %s:\n", os.Args[0])
+	flag.PrintDefaults()
+	fmt.Fprintf(out, "\nExit codes:\n")
+	fmt.Fprintf(out, "  0\tSuccess.\n")
+	fmt.Fprintf(out, "  %d\tError, such as an unreachable server or an unreadable index.\n", exitError)
+	fmt.Fprintf(out, "  %d\tNo indexed file matched the query, or nothing is indexed yet.\n", exitNoResults)
+}
+
+// getEnvFloat returns the environment variable parsed as float or the
+// default value when it is unset or not a number.
+func getEnvFloat(key string, def float64) float64 {
+	v, err := strconv.ParseFloat(os.Getenv(key), 64)
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// getEnvDuration returns the environment variable parsed as a duration,
+// either a plain number of seconds or a string such as "90s" or "5m", or
+// def when it is unset or invalid.
+func getEnvDuration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if secs, err := strconv.ParseFloat(v, 64); err == nil {
+		return time.Duration(secs * float64(time.Second))
+	}
+	if d, err := time.ParseDuration(v); err == nil {
+		return d
+	}
+	return def
+}
+
+// getEnvFloatPtr returns the environment variable parsed as float or nil
+// when it is unset or not a number.
+func getEnvFloatPtr(key string) *float64 {
+	v, err := strconv.ParseFloat(os.Getenv(key), 64)
+	if err != nil {
+		return nil
+	}
+	return &v
+}
+
+// getEnvIntPtr returns the environment variable parsed as int or nil when
+// it is unset or not a number.
+func getEnvIntPtr(key string) *int {
+	v, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return nil
+	}
+	return &v
+}
+
+// floatFlag defines a flag that sets *p only when it is given.
+func floatFlag(p **float64, name string, usage string) {
+	flag.Func(name, usage, func(s string) error {
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		*p = &v
+		return nil
+	})
+}
+
+// intFlag defines a flag that sets *p only when it is given.
+func intFlag(p **int, name string, usage string) {
+	flag.Func(name, usage, func(s string) error {
+		v, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		*p = &v
+		return nil
+	})
+}
+
+func getBodyAsText(cl io.ReadCloser) string {
+	body, _ := io.ReadAll(cl)
+	return string(body)
+}
+
+// Backend is an inference server that produces embeddings and LLM
+// completions. Responses of all backends are converted to the Ollama shape.
+// Requests are abandoned when their context is canceled.
+type Backend interface {
+	// Embed returns one embedding per input, in the order of the inputs.
+	Embed(ctx context.Context, inputs []string) (EmbeddingResponse, error)
+	Generate(ctx context.Context, prompt string, out io.Writer) (OllamaResponse, error)
+	// Models returns the names of the models available on the server.
+	Models(ctx context.Context) ([]string, error)
+}
+
+// newBackend returns the backend registered under the given name.
+func newBackend(name string) (Backend, error) {
+	switch name {
+	case "ollama":
+		return ollamaBackend{}, nil
+	case "openai":
+		return openAIBackend{}, nil
+	case "offline":
+		return offlineBackend{}, nil
+	default:
+		return nil, fmt.Errorf("unknown backend %q, expected ollama, openai or offline", name)
+	}
+}
+
+// vectorModel returns the model the vectors of the current backend are
+// recorded with. Offline vectors hash words whatever CCRAG_EMBED_MODEL is.
+func vectorModel() string {
+	if backendName == "offline" {
+		return offlineModel
+	}
+	return embedModel
+}
+
+// embedder sends embedding requests to a backend, in batches of up to
+// batch inputs and retrying failed requests up to retries times. Tests use
+// an embedder of their own instead of the one configured by the settings.
+type embedder struct {
+	backend Backend
+	batch   int
+	retries int
+}
+
+// defaultEmbedder returns the embedder configured by the settings.
+func defaultEmbedder() embedder {
+	return embedder{backend: backend, batch: embedBatch, retries: embedRetries}
+}
+
+// embed embeds the inputs with the embedder configured by the settings.
+func embed(ctx context.Context, inputs ...string) (EmbeddingResponse, error) {
+	return defaultEmbedder().embed(ctx, inputs...)
+}
+
+// embedChunks embeds the inputs with the embedder configured by the
+// settings.
+func embedChunks(ctx context.Context, inputs []string) ([][]float64, error) {
+	return defaultEmbedder().embedChunks(ctx, inputs)
+}
+
+// embed generates an embedding for each input, retrying retryable failed
+// requests with exponential backoff up to e.retries times. The embeddings
+// of the response are in the order of the inputs.
+func (e embedder) embed(ctx context.Context, inputs ...string) (EmbeddingResponse, error) {
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		res, err := e.backend.Embed(ctx, inputs)
+		if err == nil && len(res.Embeddings) != len(inputs) {
+			// A short response can't be mapped back to the inputs, retrying
+			// won't change what the server returns.
+			return res, fmt.Errorf("got %d embeddings for %d inputs", len(res.Embeddings), len(inputs))
+		}
+		if err == nil || attempt >= e.retries || ctx.Err() != nil || !retryable(err) {
+			return res, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return res, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// embedChunks embeds the inputs in requests of up to e.batch inputs, all of
+// them in one request when e.batch is 0. A retryable failed request is split
+// in half and retried, servers may reject requests that are too large.
+func (e embedder) embedChunks(ctx context.Context, inputs []string) ([][]float64, error) {
+	if len(inputs) == 0 {
+		return [][]float64{}, nil
+	}
+	if e.batch > 0 && len(inputs) > e.batch {
+		embeddings := make([][]float64, 0, len(inputs))
+		for start := 0; start < len(inputs); start += e.batch {
+			batch, err := e.embedChunks(ctx, inputs[start:min(start+e.batch, len(inputs))])
+			if err != nil {
+				return nil, err
+			}
+			embeddings = append(embeddings, batch...)
+		}
+		return embeddings, nil
+	}
+
+	res, err := e.embed(ctx, inputs...)
+	if err == nil || len(inputs) == 1 || ctx.Err() != nil || !retryable(err) {
+		return res.Embeddings, err
+	}
+
+	slog.Debug("embedding batch failed, splitting it", "inputs", len(inputs), "err", err)
+	half := len(inputs) / 2
+	first, err := e.embedChunks(ctx, inputs[:half])
+	if err != nil {
+		return nil, err
+	}
+	second, err := e.embedChunks(ctx, inputs[half:])
+	if err != nil {
+		return nil, err
+	}
+	return append(first, second...), nil
+}
+
+func generate(ctx context.Context, prompt string, out io.Writer) (OllamaResponse, error) {
+	return backend.Generate(ctx, prompt, out)
+}
+
+// postJSON posts the JSON body to url, abandoning the request when ctx is
+// canceled.
+func postJSON(ctx context.Context, url string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	return client.Do(req)
+}
+
+// ollamaBackend talks to the native Ollama API.
+type ollamaBackend struct{}
+
+func (ollamaBackend) Embed(ctx context.Context, inputs []string) (EmbeddingResponse, error) {
+	payload := map[string]interface{}{
+		"model": embedModel,
+		"input": inputs,
+	}
+
+	jsonData, err := json.Marshal(payload)
+	if err != nil {
+		return EmbeddingResponse{}, err
+	}
+
+	resp, err := postJSON(ctx, ollamaAddress+"/api/embed", jsonData)
+	if err != nil {
+		return EmbeddingResponse{}, err
+	}
+	defer closeBody(resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return EmbeddingResponse{}, ollamaError(resp)
+	}
+
+	var result EmbeddingResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return EmbeddingResponse{}, err
+	}
+
+	return result, nil
+}
+
+// ollamaError builds an error from a failed Ollama response, using the
+// message from its {"error": "..."} body when there is one.
+func ollamaError(resp *http.Response) error {
+	body := getBodyAsText(resp.Body)
+
+	var result struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal([]byte(body), &result); err == nil && result.Error != "" {
+		body = result.Error
+	}
+
+	return &statusError{
+		code: resp.StatusCode,
+		msg:  fmt.Sprintf("ollama request failed with status %s, %s", resp.Status, strings.TrimSpace(body)),
+	}
+}
+
+// statusError is a request the server answered with a failure status code.
+type statusError struct {
+	code int
+	msg  string
+}
+
+func (e *statusError) Error() string {
+	return e.msg
+}
+
+// retryable reports whether a failed request may succeed when sent again
+// or split into smaller ones. Network errors, server errors, requests that
+// are too large and rate limits are, other client errors such as an
+// unknown model are not.
+func retryable(err error) bool {
+	var se *statusError
+	if !errors.As(err, &se) {
+		return true
+	}
+	return se.code >= 500 || se.code == http.StatusRequestEntityTooLarge || se.code == http.StatusTooManyRequests
+}
+
+// Generate sends the prompt to the LLM and returns its response. When out is
+// not nil the response is streamed and every fragment is written to out as
+// it arrives. The returned response always holds the complete answer.
+func (ollamaBackend) Generate(ctx context.Context, prompt string, out io.Writer) (OllamaResponse, error) {
+	payload := map[string]interface{}{
+		"model":   llmModel,
+		"prompt":  prompt,
+		"stream":  out != nil,
+		"options": genOptions,
+	}
+	jsonPayload, err := json.Marshal(payload)
+	if err != nil {
+		return OllamaResponse{}, err
+	}
+
+	resp, err := postJSON(ctx, ollamaAddress+"/api/generate", jsonPayload)
+	if err != nil {
+		return OllamaResponse{}, err
+	}
+	defer closeBody(resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return OllamaResponse{}, ollamaError(resp)
+	}
+
+	ollamaResp := OllamaResponse{}
+	decoder := json.NewDecoder(resp.Body)
+
+	if out == nil {
+		if err := decoder.Decode(&ollamaResp); err != nil {
+			return OllamaResponse{}, err
+		}
+		if ollamaResp.Error != "" {
+			return OllamaResponse{}, fmt.Errorf("generation failed, %s", ollamaResp.Error)
+		}
+		if !ollamaResp.Done {
+			return OllamaResponse{}, errors.New("generation failed, the response is incomplete")
+		}
+		return ollamaResp, nil
+	}
+
+	// Streamed responses are newline-delimited JSON objects each carrying
+	// a fragment of the answer. The last one also carries the statistics.
+	var answer strings.Builder
+	for {
+		var part OllamaResponse
+		if err := decoder.Decode(&part); err == io.EOF {
+			break
+		} else if err != nil {
+			return OllamaResponse{}, err
+		}
+		if part.Error != "" {
+			return OllamaResponse{}, fmt.Errorf("generation failed, %s", part.Error)
+		}
+
+		if _, err := io.WriteString(out, part.Response); err != nil {
+			return OllamaResponse{}, err
+		}
+		answer.WriteString(part.Response)
+
+		ollamaResp = part
+		if part.Done {
+			break
+		}
+	}
+
+	// The server gave up without saying why
+	if !ollamaResp.Done {
+		return OllamaResponse{}, errors.New("generation failed, the response stream ended early")
+	}
+	ollamaResp.Response = answer.String()
+
+	return ollamaResp, nil
+}
+
+// Models lists the locally available models using the /api/tags endpoint.
+func (ollamaBackend) Models(ctx context.Context) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ollamaAddress+"/api/tags", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer closeBody(resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, ollamaError(resp)
+	}
+
+	var result struct {
+		Models []struct {
+			Name string `json:"name"`
+		} `json:"models"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	models := []string{}
+	for _, m := range result.Models {
+		models = append(models, m.Name)
+	}
+	return models, nil
+}
+
+// hasModel reports whether name is one of models. Ollama lists models with
+// their tag, a name without one refers to the latest tag.
+func hasModel(models []string, name string) bool {
+	for _, m := range models {
+		if m == name || m == name+":latest" {
+			return true
+		}
+	}
+	return false
+}
+
+// readLines returns all lines read from r.
+func readLines(r io.Reader) ([]string, error) {
+	scanner := bufio.NewScanner(r)
+
+	var lines []string
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+
+	return lines, scanner.Err()
+}
+
+func readFileInChunks(filename string, chunkSize int) ([]string, error) {
+	text, err := readText(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	chunks := []string{}
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	scanner.Split(bufio.ScanWords)
+
+	var wordCount int
+	var currentChunk strings.Builder
+
+	for scanner.Scan() {
+		word := scanner.Text()
+		currentChunk.WriteString(word + " ")
+		wordCount++
+
+		if wordCount == chunkSize {
+			chunks = append(chunks, currentChunk.String())
+			currentChunk.Reset()
+			wordCount = 0
+		}
+	}
+
+	// Add any remaining words
+	if currentChunk.Len() > 0 {
+		chunks = append(chunks, currentChunk.String())
+	}
+
+	if err := scanner.Err(); err != nil {
+		return chunks, err
+	}
+
+	return chunks, nil
+}
+
+// isUpToDate reports whether the stored embedding of source was produced
+// from its current version. Embedding files without a stored source
+// modification time are always considered stale.
+func isUpToDate(source string, srcInfo os.FileInfo) bool {
+	embFile, err := store.Get(source)
+	if err != nil {
+		return false
+	}
+
+	if embFile.SourceModTime.IsZero() {
+		return false
+	}
+
+	return !srcInfo.ModTime().After(embFile.SourceModTime)
+}
+
+// isBinary reports whether the file looks like binary data rather than
+// text, judging by its first bytes.
+func isBinary(filename string) (bool, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return false, err
+	}
+	head = head[:n]
+
+	if bytes.IndexByte(head, 0) != -1 {
+		return true, nil
+	}
+
+	return !strings.HasPrefix(http.DetectContentType(head), "text/"), nil
+}
+
+// checkSource runs the checks deciding whether the source needs to be
+// embedded. The error wraps errSkipped or errUpToDate when it doesn't.
+func checkSource(in string) (os.FileInfo, error) {
+	srcInfo, err := os.Stat(in)
+	if err != nil {
+		return nil, err
+	}
+
+	if maxFileBytes > 0 && srcInfo.Size() > int64(maxFileBytes) {
+		return nil, fmt.Errorf("%w: %s is larger than %d bytes", errSkipped, in, maxFileBytes)
+	}
+
+	// Known document formats are converted to text before chunking, any
+	// other binary file can't be embedded
+	if e, ok := extractorFor(in); ok {
+		if err := checkExtractor(e); err != nil {
+			return nil, fmt.Errorf("%w: %s, %v", errSkipped, in, err)
+		}
+	} else {
+		binary, err := isBinary(in)
+		if err != nil {
+			return nil, err
+		}
+		if binary {
+			return nil, fmt.Errorf("%w: %s is not a text file", errSkipped, in)
+		}
+	}
+
+	// Skip sources that have not changed since they were last embedded
+	if !forceEmbed && isUpToDate(in, srcInfo) {
+		return nil, errUpToDate
+	}
+
+	return srcInfo, nil
+}
+
+// embedPath embeds the target source file with its chunking settings and
+// stores the embeddings.
+func embedPath(ctx context.Context, t embedTarget) error {
+	in := t.Path
+	srcInfo, err := checkSource(in)
+	if err != nil {
+		return err
+	}
+
+	chunks, err := chunkFile(in, t.ChunkSize, t.Strategy)
+	if err != nil {
+		return err
+	}
+
+	// A handful of words, like a lone title line, gives a vector that
+	// matches loosely related queries as well as the right ones
+	if words := countWords(chunks); words < minFileWords {
+		slog.Warn("file is too short for a stable embedding, extend it or merge it into a related note", "path", in, "words", words, "min", minFileWords)
+	}
+
+	// Ground every chunk in the document it comes from
+	header := ""
+	if embedMetadata {
+		header = metadataHeader(in)
+	}
+
+	// Skip repeated chunks such as boilerplate so they are embedded once
+	// and don't outweigh the rest of the file when scores are averaged.
+	fileChunks := newChunkSet()
+	chunkIndex := []int{}
+	texts := []string{}
+	for i, c := range chunks {
+		if !fileChunks.add(c) || (globalChunks != nil && !globalChunks.add(c)) {
+			continue
+		}
+		texts = append(texts, c)
+		chunkIndex = append(chunkIndex, i)
+	}
+
+	// Keep huge files from dominating embed time and the index, the kept
+	// chunks are spread over the whole file.
+	if maxChunksPerFile > 0 && len(texts) > maxChunksPerFile {
+		slog.Debug("capping chunks", "path", in, "chunks", len(texts), "max", maxChunksPerFile)
+		keep := sampleChunks(len(texts), maxChunksPerFile)
+		sampledTexts := make([]string, len(keep))
+		sampledIndex := make([]int, len(keep))
+		for k, j := range keep {
+			sampledTexts[k] = texts[j]
+			sampledIndex[k] = chunkIndex[j]
+		}
+		texts, chunkIndex = sampledTexts, sampledIndex
+	}
+
+	inputs := make([]string, len(texts))
+	for j, c := range texts {
+		inputs[j] = header + c
+	}
+
+	embeddings, err := embedCached(ctx, inputs)
+	if err != nil {
+		// A partially embedded file would silently misrepresent the
+		// source, so give up on the whole file instead.
+		return fmt.Errorf("failed to generate embedding for source file %s, %w", in, err)
+	}
+
+	// Vectors are returned in input order, map them back to their chunk.
+	// Dot product and euclidean distance depend on the magnitudes the
+	// model produced, only cosine similarity can do without them.
+	normalized := metric == "cosine"
+	for j, vec := range embeddings {
+		if len(vec) == 0 {
+			return fmt.Errorf("embedding is empty for source file %s, chunk %d", in, chunkIndex[j])
+		}
+		if normalized {
+			embeddings[j] = ix.Normalize(vec)
+		}
+	}
+
+	if len(chunkIndex) == len(chunks) {
+		chunkIndex = nil
+	}
+
+	embeddedFile := EmbeddingFile{
+		Embeddings: embeddings,
+		ChunkSize:  t.ChunkSize,
+		Source:     in,
+		Model:      vectorModel(),
+
+		ChunkStrategy: t.Strategy,
+
+		SourceModTime: srcInfo.ModTime(),
+		Normalized:    normalized,
+		ChunkIndex:    chunkIndex,
+	}
+	if storeChunks {
+		embeddedFile.Chunks = texts
+	}
+	if quantize == "int8" {
+		embeddedFile = embeddedFile.Quantize()
+	}
+
+	return store.Put(embeddedFile)
+}
+
+// sampleChunks returns limit positions out of n evenly spread from the
+// first to the last one.
+func sampleChunks(n int, limit int) []int {
+	if limit == 1 {
+		return []int{0}
+	}
+
+	keep := make([]int, limit)
+	for k := range keep {
+		keep[k] = k * (n - 1) / (limit - 1)
+	}
+	return keep
+}
+
+// saveStdinContent writes everything read from stdin to a file called name
+// inside dir and returns its path. Without a name one is made up from the
+// current time.
+func saveStdinContent(dir string, name string) (string, error) {
+	if name == "" {
+		name = time.Now().Format("stdin-20060102-150405.txt")
+	}
+	if name != filepath.Base(name) || name == "." || name == ".." {
+		return "", fmt.Errorf("invalid document name %q", name)
+	}
+
+	data, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return "", err
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return "", errors.New("nothing to embed on stdin")
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+// dryRunEmbed reports what embedding the paths would do, the number of
+// chunks sent to the embedding model for every file and the requests they
+// take, and the totals, without calling the model or touching the store.
+func dryRunEmbed(targets []embedTarget) {
+	newFiles, changed, upToDate, skipped, failed, chunkCount, calls := 0, 0, 0, 0, 0, 0, 0
+	for _, t := range targets {
+		p := t.Path
+		_, err := checkSource(p)
+		if errors.Is(err, errUpToDate) {
+			fmt.Printf("up to date\t%s\n", p)
+			upToDate++
+			continue
+		}
+		if errors.Is(err, errSkipped) {
+			fmt.Printf("skip\t%s\n", err)
+			skipped++
+			continue
+		}
+		if err != nil {
+			slog.Warn("failed to check file", "err", err)
+			failed++
+			continue
+		}
+
+		chunks, err := chunkFile(p, t.ChunkSize, t.Strategy)
+		if err != nil {
+			slog.Warn("failed to chunk file", "err", err)
+			failed++
+			continue
+		}
+
+		n := 0
+		fileChunks := newChunkSet()
+		for _, c := range chunks {
+			if fileChunks.add(c) && (globalChunks == nil || globalChunks.add(c)) {
+				n++
+			}
+		}
+		if maxChunksPerFile > 0 {
+			n = min(n, maxChunksPerFile)
+		}
+		requests := batchRequests(n)
+		chunkCount += n
+		calls += requests
+
+		state := "new"
+		if _, err := store.Get(p); err == nil {
+			state = "changed"
+			changed++
+		} else {
+			newFiles++
+		}
+		fmt.Printf("%s\t%s\t%d chunks\t%d requests\n", state, p, n, requests)
+	}
+
+	fmt.Printf("Would embed %d new and %d changed files, %d chunks in %d embedding requests, %d up to date, %d skipped, %d failed\n",
+		newFiles, changed, chunkCount, calls, upToDate, skipped, failed)
+}
+
+// batchRequests returns the number of embedding requests sending n chunks
+// takes, in batches of up to embedBatch chunks.
+func batchRequests(n int) int {
+	if n == 0 {
+		return 0
+	}
+	if embedBatch <= 0 {
+		return 1
+	}
+	return (n + embedBatch - 1) / embedBatch
+}
+
+// embedProgress tracks the progress of embed mode workers and reports it on
+// stderr so it doesn't mix with the regular output.
+type embedProgress struct {
+	mu      sync.Mutex
+	start   time.Time
+	total   int
+	done    int
+	skipped int
+	failed  int
+	// added and updated are the sources embedded for the first time and
+	// embedded again, reported by -incremental
+	added   []string
+	updated []string
+}
+
+func newEmbedProgress(total int) *embedProgress {
+	return &embedProgress{start: time.Now(), total: total}
+}
+
+// update records the outcome of embedding a single file.
+func (p *embedProgress) update(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.done++
+	if errors.Is(err, errUpToDate) || errors.Is(err, errSkipped) {
+		p.skipped++
+	} else if err != nil {
+		p.failed++
+	}
+
+	fmt.Fprintf(stderr, "\rembedded %d/%d", p.done, p.total)
+}
+
+// embedded records a source that was embedded, existed tells whether it
+// had embeddings before.
+func (p *embedProgress) embedded(source string, existed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if existed {
+		p.updated = append(p.updated, source)
+	} else {
+		p.added = append(p.added, source)
+	}
+}
+
+// changes prints the added and updated sources on stdout.
+func (p *embedProgress) changes() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, c := range []struct {
+		label   string
+		sources []string
+	}{{"Added", p.added}, {"Updated", p.updated}} {
+		slices.Sort(c.sources)
+		fmt.Printf("%s: %d\n", c.label, len(c.sources))
+		for _, s := range c.sources {
+			fmt.Printf("\t%s\n", s)
+		}
+	}
+}
+
+func (p *embedProgress) summary() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	fmt.Fprintf(stderr, "\nDone in %s, %d files, %d skipped, %d failed\n",
+		time.Since(p.start).Round(time.Millisecond), p.total, p.skipped, p.failed)
+}
+
+// catchInterrupt makes the first SIGINT set interrupted instead of killing
+// the process, so files being embedded are finished and stored before
+// exiting. A second SIGINT calls cancel to abandon the requests in flight.
+// The returned function restores the default behavior.
+func catchInterrupt(interrupted *atomic.Bool, cancel context.CancelFunc) func() {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt)
+
+	go func() {
+		if _, ok := <-sigs; !ok {
+			return
+		}
+		interrupted.Store(true)
+		slog.Warn("interrupted, finishing the files being embedded, interrupt again to exit immediately")
+
+		if _, ok := <-sigs; ok {
+			cancel()
+		}
+	}()
+
+	return func() {
+		signal.Stop(sigs)
+		close(sigs)
+	}
 }
 
-var ollamaAddress = cc.GetEnv("CCRAG_OLLAMA_ADDRESS", "http://localhost:11434")
-var embedModel = cc.GetEnv("CCRAG_EMBED_MODEL", "mxbai-embed-large")
-var llmModel = cc.GetEnv("CCRAG_LLM_MODEL", "mistral:latest")
-var maxResults = cc.GetEnvInt("CCRAG_MAX_RESULTS", 10)
-var chunkSize = cc.GetEnvInt("CCRAG_WORDS_PER_CHUNK", 100)
-var embedDirName = "embed"
-var embedFormat = "json"
+// listEmbeddings prints every indexed source along with the number of
+// stored chunks and the chunk size it was embedded with.
+func listEmbeddings(verbose bool) error {
+	return store.Walk(func(name string, embFile EmbeddingFile, err error) error {
+		if err != nil {
+			slog.Warn("failed to read embedding file", "err", err)
+			return nil
+		}
 
-var client = &http.Client{
-	Timeout: 3 * time.Minute,
+		if verbose {
+			dims := 0
+			if len(embFile.Embeddings) > 0 {
+				dims = len(embFile.Embeddings[0])
+			}
+			fmt.Printf("%s\tchunks: %d\tchunk size: %d\tdims: %d\tmodel: %s\n", embFile.Source, len(embFile.Embeddings), embFile.ChunkSize, dims, embFile.Model)
+			return nil
+		}
+
+		fmt.Printf("%s\tchunks: %d\tchunk size: %d\n", embFile.Source, len(embFile.Embeddings), embFile.ChunkSize)
+		return nil
+	})
 }
 
-// cosineSimilarity calculates cosine similarity (magnitude-adjusted dot
-// product) between two vectors that must be of the same size.
-func cosineSimilarity(a, b []float64) float64 {
-	if len(a) != len(b) {
-		panic("different lengths")
+// pruneEmbeddings removes embedding files whose source file no longer
+// exists. With dryRun set it only reports what would be removed.
+func pruneEmbeddings(dryRun bool) error {
+	removed := 0
+	err := store.Walk(func(name string, embFile EmbeddingFile, err error) error {
+		if err != nil {
+			slog.Warn("failed to read embedding file", "err", err)
+			return nil
+		}
+
+		if _, err := os.Stat(embFile.Source); !os.IsNotExist(err) {
+			return nil
+		}
+
+		if dryRun {
+			fmt.Printf("Would remove %s (source %s)\n", name, embFile.Source)
+			removed++
+			return nil
+		}
+
+		if err := store.Delete(embFile.Source); err != nil {
+			slog.Warn("failed to remove embedding file", "file", name, "err", err)
+			return nil
+		}
+		fmt.Printf("Removed %s (source %s)\n", name, embFile.Source)
+		removed++
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
-	var aMag, bMag, dotProduct float64
-	for i := 0; i < len(a); i++ {
-		aMag += a[i] * a[i]
-		bMag += b[i] * b[i]
-		dotProduct += a[i] * b[i]
+	if dryRun {
+		fmt.Printf("Would remove %d embedding files\n", removed)
+	} else {
+		fmt.Printf("Removed %d embedding files\n", removed)
 	}
-	return dotProduct / (math.Sqrt(aMag) * math.Sqrt(bMag))
-}
 
-func getBodyAsText(cl io.ReadCloser) string {
-	body, _ := io.ReadAll(cl)
-	return string(body)
+	return nil
 }
 
-func embed(data string) (EmbeddingResponse, error) {
-	payload := map[string]string{
-		"model": embedModel,
-		"input": data,
-	}
+// indexedSources returns the sources of every embedding file that still
+// exist. Missing sources are reported and left out.
+func indexedSources() ([]string, error) {
+	var sources []string
+	missing := 0
+	err := store.Walk(func(name string, embFile EmbeddingFile, err error) error {
+		if err != nil {
+			slog.Warn("failed to read embedding file", "err", err)
+			return nil
+		}
 
-	jsonData, err := json.Marshal(payload)
-	if err != nil {
-		return EmbeddingResponse{}, err
+		if _, err := os.Stat(embFile.Source); err != nil {
+			slog.Warn("skipping missing source", "path", embFile.Source, "err", err)
+			missing++
+			return nil
+		}
+		sources = append(sources, embFile.Source)
+		return nil
+	})
+	if missing > 0 {
+		slog.Warn("some sources are missing, run ccrag -prune to remove their embeddings", "missing", missing)
 	}
+	return sources, err
+}
 
-	resp, err := client.Post(ollamaAddress+"/api/embed", "application/json", bytes.NewBuffer(jsonData))
-	if err != nil {
-		return EmbeddingResponse{}, err
-	}
-	defer resp.Body.Close()
+// removeEmbedding deletes the embeddings of the given source, or of the
+// source whose derived embedding file name is name when byName is set.
+func removeEmbedding(source string, byName bool) error {
+	if byName {
+		// Accept the file name as listed in the embed directory too
+		for _, ext := range embedExtensions() {
+			source = strings.TrimSuffix(source, "."+ext)
+		}
+
+		// Mirrored sources can also be named by their path in the directory
+		name := filepath.Clean(source)
+		matches := map[string]string{}
+		err := store.Walk(func(file string, embFile EmbeddingFile, err error) error {
+			trimmed := file
+			for _, ext := range embedExtensions() {
+				trimmed = strings.TrimSuffix(trimmed, "."+ext)
+			}
+			// Names under fullpath-hash can be given without their hash
+			if err == nil && (strings.HasSuffix(trimmed, string(filepath.Separator)+name) ||
+				strings.HasSuffix(trimNameHash(trimmed), string(filepath.Separator)+name)) {
+				matches[embFile.Source] = file
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
 
-	if resp.StatusCode != http.StatusOK {
-		return EmbeddingResponse{}, fmt.Errorf("request failed with status %d, %s", resp.StatusCode, getBodyAsText(resp.Body))
+		if len(matches) == 0 {
+			return fmt.Errorf("no embeddings named %s", name)
+		}
+		// Deleting one of several matches would likely hit the wrong source
+		if len(matches) > 1 {
+			candidates := []string{}
+			for s, file := range matches {
+				candidates = append(candidates, fmt.Sprintf("%s (source %s)", file, s))
+			}
+			slices.Sort(candidates)
+			return fmt.Errorf("%s matches %d embedding files, give more of its path: %s", name, len(matches), strings.Join(candidates, ", "))
+		}
+		for s := range matches {
+			source = s
+		}
 	}
 
-	var result EmbeddingResponse
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return EmbeddingResponse{}, err
+	err := store.Delete(source)
+	if errors.Is(err, fs.ErrNotExist) {
+		// Sources are stored as they were given, try the absolute path too
+		if abs, absErr := filepath.Abs(source); absErr == nil && abs != source {
+			source = abs
+			err = store.Delete(source)
+		}
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("no embeddings for %s", source)
+	}
+	if err != nil {
+		return err
 	}
 
-	return result, nil
+	fmt.Printf("Removed embeddings of %s\n", source)
+	return nil
 }
 
-func readFileInChunks(filename string, chunkSize int) ([]string, error) {
-	file, err := os.Open(filename)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
+// checkEmbeddings scans every embedding file and reports inconsistencies
+// that would otherwise only surface while querying. It returns an error
+// when any problem was found.
+func checkEmbeddings() error {
+	files, empty, broken, mixed := 0, 0, 0, 0
+	dims := map[int]int{}
+	models := map[string]int{}
 
-	chunks := []string{}
-	scanner := bufio.NewScanner(file)
-	scanner.Split(bufio.ScanWords)
+	err := store.Walk(func(name string, embFile EmbeddingFile, err error) error {
+		files++
+		if err != nil {
+			slog.Warn("failed to read embedding file", "err", err)
+			broken++
+			return nil
+		}
 
-	var wordCount int
-	var currentChunk strings.Builder
+		models[embFile.Model]++
 
-	for scanner.Scan() {
-		word := scanner.Text()
-		currentChunk.WriteString(word + " ")
-		wordCount++
+		if len(embFile.Embeddings) == 0 || len(embFile.Embeddings[0]) == 0 {
+			slog.Warn("no embeddings", "file", name, "source", embFile.Source)
+			empty++
+			return nil
+		}
 
-		if wordCount == chunkSize {
-			chunks = append(chunks, currentChunk.String())
-			currentChunk.Reset()
-			wordCount = 0
+		d := len(embFile.Embeddings[0])
+		dims[d]++
+		for i, emb := range embFile.Embeddings {
+			if len(emb) != d {
+				slog.Warn("chunk dimensions differ", "file", name, "chunk", i, "dims", len(emb), "expected", d)
+				mixed++
+				break
+			}
 		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
-	// Add any remaining words
-	if currentChunk.Len() > 0 {
-		chunks = append(chunks, currentChunk.String())
+	dimKeys := make([]int, 0, len(dims))
+	for d := range dims {
+		dimKeys = append(dimKeys, d)
 	}
+	slices.Sort(dimKeys)
 
-	if err := scanner.Err(); err != nil {
-		return chunks, err
+	modelKeys := make([]string, 0, len(models))
+	for m := range models {
+		modelKeys = append(modelKeys, m)
 	}
+	slices.Sort(modelKeys)
 
-	return chunks, nil
+	fmt.Printf("Files: %d\n", files)
+	for _, d := range dimKeys {
+		fmt.Printf("Dimensions %d: %d files\n", d, dims[d])
+	}
+	for _, m := range modelKeys {
+		fmt.Printf("Model %s: %d files\n", m, models[m])
+	}
+	fmt.Printf("Empty: %d\n", empty)
+	fmt.Printf("Unreadable: %d\n", broken)
+	fmt.Printf("Mixed dimensions: %d\n", mixed)
+
+	problems := empty + broken + mixed
+	if len(dims) > 1 {
+		slog.Warn("embeddings of different dimensions can't be compared, re-embed the index with a single model")
+		problems++
+	}
+	if problems > 0 {
+		return fmt.Errorf("found %d problems", problems)
+	}
+
+	return nil
 }
 
-func embedPath(in string, out string) error {
-	chunks, err := readFileInChunks(in, chunkSize)
-	if err != nil {
-		return err
+// sourceChunks returns the number of chunks the source was split into,
+// including repeated chunks that weren't embedded.
+func sourceChunks(f EmbeddingFile) int {
+	if len(f.ChunkIndex) == 0 {
+		return len(f.Embeddings)
 	}
+	return f.ChunkIndex[len(f.ChunkIndex)-1] + 1
+}
 
-	if _, err := os.Stat(out); err == nil {
-		// TODO: Add ModTime comparison with a stored date of last modification inside embedding file
-		// Skip existing files
+// dirSize returns the total size of the regular files in dir and below it.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
 		return nil
-	}
+	})
+	return size, err
+}
 
-	embeddings := [][]float64{}
-	for _, c := range chunks {
-		res, err := embed(c)
+// printStats summarizes the size of the index in dir, the number of
+// sources, chunks and vectors along with their dimensions and models.
+func printStats(dir string) error {
+	sources, chunks, vectors := 0, 0, 0
+	dims := map[int]int{}
+	models := map[string]int{}
+
+	err := store.Walk(func(name string, embFile EmbeddingFile, err error) error {
 		if err != nil {
-			fmt.Printf("[!] Failed to generate embedding for source file %s, %s\n", in, err)
-			continue
+			slog.Warn("failed to read embedding file", "err", err)
+			return nil
 		}
 
-		if len(res.Embeddings) == 0 {
-			fmt.Printf("[!] Embedding are empty for file %s\n", in)
-			continue
+		sources++
+		chunks += sourceChunks(embFile)
+		vectors += len(embFile.Embeddings)
+		models[embFile.Model]++
+		if len(embFile.Embeddings) > 0 {
+			dims[len(embFile.Embeddings[0])]++
 		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
 
-		embeddings = append(embeddings, res.Embeddings[0])
+	size, err := dirSize(dir)
+	if err != nil {
+		return err
 	}
 
-	embeddedFile := EmbeddingFile{
-		Embeddings: embeddings,
-		ChunkSize:  chunkSize,
-		Source:     in,
+	dimKeys := make([]int, 0, len(dims))
+	for d := range dims {
+		dimKeys = append(dimKeys, d)
 	}
+	slices.Sort(dimKeys)
 
-	embedJson, err := json.Marshal(embeddedFile)
-	if err != nil {
-		return err
+	modelKeys := make([]string, 0, len(models))
+	for m := range models {
+		modelKeys = append(modelKeys, m)
 	}
+	slices.Sort(modelKeys)
 
-	if err := os.WriteFile(out, embedJson, 0644); err != nil {
-		return err
+	fmt.Printf("Sources: %d\n", sources)
+	fmt.Printf("Chunks: %d\n", chunks)
+	fmt.Printf("Vectors: %d\n", vectors)
+	if sources > 0 {
+		fmt.Printf("Vectors per source: %.1f\n", float64(vectors)/float64(sources))
+	}
+	for _, d := range dimKeys {
+		fmt.Printf("Dimensions %d: %d files\n", d, dims[d])
 	}
+	for _, m := range modelKeys {
+		fmt.Printf("Model %s: %d files\n", m, models[m])
+	}
+	fmt.Printf("Size: %d bytes\n", size)
 
 	return nil
 }
 
 func main() {
+	setupLogging(false)
+
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		fatal(err.Error())
+	}
+
+	// The config file only provides values for variables missing from the
+	// environment, flags parsed below override both.
+	configPath := cc.GetEnv("CCRAG_CONFIG", filepath.Join(homeDir, ".ccrag", "config.json"))
+	if err := applyConfigFile(configPath); err != nil {
+		fatal("failed to load config file", "err", err)
+	}
+	loadSettings()
+
 	embedMode := flag.Bool("e", false, "Embedding mode. Process list of text file provided over stdin.")
+	var dirs []string
+	flag.Func("dir", "Directory to recursively embed in embedding mode instead of reading paths from stdin. Can be repeated.", func(s string) error {
+		dirs = append(dirs, s)
+		return nil
+	})
+	stdinContent := flag.Bool("stdin-content", false, "Embed everything read from stdin as a single document instead of a list of paths. Same as -e -.")
+	manifest := flag.Bool("manifest", false, "Read a JSON manifest of files to embed from stdin in embedding mode instead of a list of paths. Entries have a path and optionally their own chunk_size and strategy.")
+	docName := flag.String("name", "", "File name to store the document embedded with -stdin-content under. Defaults to a timestamped name.")
+	var contextFiles []string
+	flag.Func("context", "File to use as context in query mode instead of searching the index. Can be repeated.", func(s string) error {
+		contextFiles = append(contextFiles, s)
+		return nil
+	})
 	query := flag.String("q", "", "Query mode. Search for the given query. And generate LLM response with context from similarity search.")
 	similarityOnly := flag.Bool("s", false, "Run similarity search only. Output found file list.")
+	showScores := flag.Bool("scores", false, "Print the score of every file found with -s before its path, separated by a tab.")
+	listMode := flag.Bool("l", false, "List mode. Print all indexed sources with their chunk counts.")
+	reindex := flag.Bool("reindex", false, "Embed every indexed source again with the current model and chunk settings, overwriting its embeddings. Missing sources are skipped.")
+	pruneMode := flag.Bool("prune", false, "Prune mode. Delete embeddings whose source files no longer exist.")
+	rmSource := flag.String("rm", "", "Delete the embeddings of the given source file.")
+	rmName := flag.String("rm-name", "", "Delete the embeddings stored under the given embedding file name, or its path inside the embed directory.")
+	checkMode := flag.Bool("check", false, "Check mode. Report embedding dimensions, models and unreadable or empty embedding files.")
+	statsMode := flag.Bool("stats", false, "Stats mode. Summarize the number of sources, chunks and vectors, their dimensions and models and the size of the index on disk.")
+	dedupMode := flag.Bool("dedup-report", false, "Print pairs of indexed files more similar to each other than CCRAG_DEDUP_THRESHOLD, likely near duplicates.")
+	evalFile := flag.String("eval", "", "Eval mode. Search for the queries of a JSON list of {query, expected_sources} cases and report precision and recall of the -n files found and their mean reciprocal rank.")
+	flag.BoolVar(&forceEmbed, "force", false, "Embed every source again, even when its embeddings are up to date. Use after changing chunking settings.")
+	dedupeGlobal := flag.Bool("dedupe-global", false, "Skip chunks already embedded from other files in this run, not only repeats within a file.")
+	incremental := flag.Bool("incremental", false, "Embed only new and changed files and print the sources that were added and updated, for scheduled runs.")
+	dryRun := flag.Bool("dry-run", false, "Report what would be embedded or pruned without touching anything.")
 	verbose := flag.Bool("v", false, "Verbose mode.")
+	veryVerbose := flag.Bool("vv", false, "Very verbose mode. Also print the score of every chunk. Same as CCRAG_VERBOSE=2.")
+	cite := flag.Bool("cite", false, "Print the source files used as context after the LLM answer.")
+	jsonOutput := flag.Bool("json", false, "Print results as JSON. A list of scored files with -s, otherwise the answer with its sources.")
+	reset := flag.Bool("reset", false, "Forget the conversation kept in CCRAG_SESSION. Combined with -q the question starts a new conversation.")
+	jsonLines := flag.Bool("jsonl", false, "Print results as JSON Lines, one object per line as they are selected. A scored file per line with -s, otherwise the answer with its sources. Lines carry the query they belong to.")
+	promptName := flag.String("prompt", "", "Answer with the named prompt template, read from <name>.tmpl in CCRAG_PROMPT_DIR or one of the built-in default and code templates.")
+	explain := flag.Bool("explain", false, "Print why every file was selected, its score, best matching chunk and the start of that chunk, before the answer. Instead of the file list with -s.")
+	answerOnly := flag.Bool("answer-only", false, "Print nothing but the LLM answer on stdout, for scripts. Drops -cite and -explain output, diagnostics go to stderr.")
+	contextOnly := flag.Bool("context-only", false, "Print the context that would be sent to the LLM, the text of every selected file, without generating an answer.")
+	separators := flag.Bool("context-separators", true, "Precede the text of every file printed by -context-only with a --- source: path --- line.")
+	showPrompt := flag.Bool("show-prompt", false, "Print the prompt that would be sent to the LLM, context included, without generating an answer.")
+	noStream := flag.Bool("no-stream", false, "Wait for the complete LLM response instead of streaming it as it is generated.")
+	modelList := flag.Bool("model-list", false, "Print the models available on the server.")
+	replMode := flag.Bool("repl", false, "Interactive mode. Load the index once and answer queries typed at a prompt.")
+	batch := flag.Bool("batch", false, "Batch mode. Read one query per line from stdin and answer each of them.")
+	watchMode := flag.Bool("watch", false, "Watch mode. Re-embed indexed sources and paths provided over stdin when they change.")
+	serveMode := flag.Bool("serve", false, "Server mode. Load the index once and answer queries over HTTP.")
+	addr := flag.String("addr", "localhost:8080", "Address to listen on in server mode.")
+	flag.IntVar(&maxResults, "n", maxResults, "Number of best matching files to print or use as context. Overrides CCRAG_MAX_RESULTS.")
+	flag.StringVar(&collection, "c", collection, "Collection to embed into and query. Overrides CCRAG_COLLECTION.")
+	flag.Func("since", "Only search sources modified within the given duration, like 36h, 7d or 2w, or after the given date, like 2006-01-02.", func(s string) error {
+		var err error
+		since, err = parseSince(s)
+		return err
+	})
+	floatFlag(&genOptions.Temperature, "temperature", "LLM sampling temperature. Overrides CCRAG_TEMPERATURE.")
+	floatFlag(&genOptions.TopP, "top-p", "LLM nucleus sampling probability. Overrides CCRAG_TOP_P.")
+	intFlag(&genOptions.NumPredict, "num-predict", "Maximum number of tokens to generate. Overrides CCRAG_NUM_PREDICT.")
+	intFlag(&genOptions.Seed, "seed", "Random seed for reproducible answers. Overrides CCRAG_SEED.")
+	flag.Usage = usage
 	flag.Parse()
 
-	homeDir, err := os.UserHomeDir()
+	if *veryVerbose {
+		verboseLevel = 2
+	} else if *verbose {
+		verboseLevel = max(verboseLevel, 1)
+	}
+	*verbose = verboseLevel >= 1
+	setupLogging(*verbose)
+
+	if err := checkSettings(); err != nil {
+		fatal(err.Error())
+	}
+
+	if err := checkCollection(collection); err != nil {
+		fatal(err.Error())
+	}
+
+	// Everything ccrag stores lives in the data directory, which can be moved
+	// to a bigger disk or into a project for a project local index
+	dataDir := cc.GetEnv("CCRAG_DATA_DIR", filepath.Join(homeDir, ".ccrag"))
+	promptDir = cc.GetEnv("CCRAG_PROMPT_DIR", filepath.Join(dataDir, "prompts"))
+	weightsFile := cc.GetEnv("CCRAG_WEIGHTS_FILE", filepath.Join(dataDir, ".ccragweights"))
+
+	// Every collection is kept in its own directory so their results never mix
+	embedRoot := filepath.Join(dataDir, embedDirName)
+	embedDir := filepath.Join(embedRoot, collection)
+
+	if queryCache != "off" {
+		queryCacheDir = filepath.Join(dataDir, "query_cache")
+	}
+	if chunkCache == "on" {
+		chunkCacheDir = filepath.Join(dataDir, "cache")
+	}
+
+	tlsConf, err := tlsConfig()
+	if err != nil {
+		fatal(err.Error())
+	}
+	client = newHTTPClient(httpTimeout, embedWorkers, tlsConf)
+
+	backend, err = newBackend(backendName)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		fatal(err.Error())
 	}
 
-	embedDir := filepath.Join(homeDir, ".ccrag", embedDirName)
+	if *promptName != "" {
+		promptTemplate, err = loadNamedPrompt(*promptName)
+	} else {
+		promptTemplate, err = loadPromptTemplate()
+		// Unless a prompt is configured, code gets a prompt of its own
+		if err == nil && promptTemplateText == "" && promptFile == "" {
+			codePrompt, err = loadNamedPrompt("code")
+		}
+	}
+	if err != nil {
+		fatal("failed to load prompt template", "err", err)
+	}
 
 	if *verbose {
-		fmt.Printf("[D] Embedding storage directory: %s\n", embedDir)
-		fmt.Printf("[D] CCRAG_OLLAMA_ADDRESS: %s\n", ollamaAddress)
-		fmt.Printf("[D] CCRAG_EMBED_MODEL: %s\n", embedModel)
-		fmt.Printf("[D] CCRAG_LLM_MODEL: %s\n", llmModel)
-		fmt.Printf("[D] CCRAG_WORDS_PER_CHUNK: %d\n", chunkSize)
+		slog.Debug("settings",
+			"config_file", configPath,
+			"CCRAG_DATA_DIR", dataDir,
+			"embed_dir", embedDir,
+			"CCRAG_COLLECTION", collection,
+			"CCRAG_QUERY_CACHE", queryCache,
+			"CCRAG_CHUNK_CACHE", chunkCache,
+			"CCRAG_BACKEND", backendName,
+			"CCRAG_OLLAMA_ADDRESS", ollamaAddress,
+			"CCRAG_OPENAI_ADDRESS", openAIAddress,
+			"CCRAG_HTTP_TIMEOUT", httpTimeout,
+			"CCRAG_CA_FILE", caFile,
+			"CCRAG_CLIENT_CERT", clientCert,
+			"CCRAG_TLS_INSECURE", tlsInsecure,
+			"CCRAG_EMBED_MODEL", embedModel,
+			"CCRAG_LLM_MODEL", llmModel,
+			"CCRAG_STORE", storeKind,
+			"CCRAG_NAMING", naming,
+			"CCRAG_EMBED_FORMAT", embedFormat,
+			"CCRAG_EMBED_COMPRESS", embedCompress,
+			"CCRAG_WORDS_PER_CHUNK", chunkSize,
+			"CCRAG_CHUNK_STRATEGY", chunkStrategy,
+			"CCRAG_MIN_CHUNK_WORDS", minChunkWords,
+			"CCRAG_MIN_FILE_WORDS", minFileWords,
+			"CCRAG_MAX_CHUNKS_PER_FILE", maxChunksPerFile,
+			"CCRAG_EMBED_METADATA", embedMetadata,
+			"CCRAG_STORE_CHUNKS", storeChunks,
+			"CCRAG_QUANTIZE", quantize,
+			"CCRAG_INDEX", indexKind,
+			"CCRAG_RETRIEVAL_UNIT", retrievalUnit,
+			"CCRAG_METRIC", metric,
+			"CCRAG_ANN_PROBES", annProbes,
+			"CCRAG_PROMPT_FILE", promptFile,
+			"CCRAG_PROMPT_DIR", promptDir,
+			"CCRAG_WEIGHTS_FILE", weightsFile,
+			"CCRAG_EMBED_RETRIES", embedRetries,
+			"CCRAG_EMBED_WORKERS", embedWorkers,
+			"CCRAG_EMBED_BATCH", embedBatch,
+			"CCRAG_MAX_FILE_BYTES", maxFileBytes,
+			"CCRAG_INCLUDE_GLOB", includeGlob,
+			"CCRAG_MAX_RESULTS", maxResults,
+			"CCRAG_MIN_SCORE", minScore,
+			"CCRAG_SCORE_MODE", scoreMode,
+			"CCRAG_HYBRID_ALPHA", hybridAlpha,
+			"CCRAG_DEDUP_THRESHOLD", dedupThreshold,
+			"CCRAG_RERANK", rerank,
+			"CCRAG_RERANK_CANDIDATES", rerankCandidates,
+			"CCRAG_CONTEXT_MODE", contextMode,
+			"CCRAG_CONTEXT_WINDOW", contextWindow,
+			"CCRAG_MAX_CONTEXT_WORDS", maxContextWords,
+			"CCRAG_SESSION", sessionFile,
+		)
+
+		// Catch typos in model names before they fail every request. Modes
+		// that only read the index mustn't need a reachable server.
+		usesModels := false
+		switch {
+		case *modelList:
+		case *embedMode || *reindex:
+			usesModels = !*dryRun
+		case *listMode, *pruneMode, *rmSource != "" || *rmName != "", *checkMode, *statsMode, *dedupMode:
+		default:
+			usesModels = *evalFile != "" || *serveMode || *watchMode || *replMode || *batch || *query != ""
+		}
+		if usesModels {
+			if models, err := backend.Models(context.Background()); err != nil {
+				slog.Warn("failed to list available models", "err", err)
+			} else {
+				for _, m := range []string{embedModel, llmModel} {
+					if !hasModel(models, m) {
+						slog.Warn("model is not available on the server", "model", m)
+					}
+				}
+			}
+		}
 	}
 
-	if _, err := os.Stat(embedDir); os.IsNotExist(err) {
-		err := os.MkdirAll(embedDir, 0755)
-		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
+	// A dry run leaves no trace, not even an empty collection
+	if !*dryRun {
+		if _, err := os.Stat(embedDir); os.IsNotExist(err) {
+			err := os.MkdirAll(embedDir, 0755)
+			if err != nil {
+				fatal("failed to create embed directory", "err", err)
+			}
+		}
+
+		// Embeddings written before collections existed live directly in
+		// the embed directory, they become the default collection
+		if err := migrateLegacyEmbeddings(embedRoot, filepath.Join(embedRoot, "default")); err != nil {
+			slog.Warn("failed to move embeddings into the default collection", "dir", embedRoot, "err", err)
 		}
 	}
 
-	if *embedMode {
+	store, err = newStore(storeKind, embedDir, *dryRun)
+	if err != nil {
+		fatal("failed to open store", "err", err)
+	}
 
-		// Accept list of paths from stdin
-		scanner := bufio.NewScanner(os.Stdin)
+	weights, err = readWeightsFile(weightsFile)
+	if err != nil {
+		fatal("failed to read weights", "err", err)
+	}
+	defer store.Close()
+
+	opts := queryOptions{
+		similarityOnly: *similarityOnly,
+		scores:         *showScores,
+		noStream:       *noStream,
+		cite:           *cite,
+		json:           *jsonOutput,
+		jsonl:          *jsonLines,
+		showPrompt:     *showPrompt,
+		explain:        *explain,
+		contextOnly:    *contextOnly,
+		separators:     *separators,
+		contextFiles:   contextFiles,
+	}
+
+	// Scripts capturing the answer must not get anything else mixed in
+	if *answerOnly {
+		if *similarityOnly || *jsonOutput || *jsonLines || *showPrompt || *contextOnly {
+			fatal("-answer-only prints the answer only, it can't be used with -s, -json, -jsonl, -show-prompt or -context-only")
+		}
+		opts.cite, opts.explain = false, false
+	}
+
+	// Ctrl-C abandons the requests in flight. Embed mode finishes the files
+	// being embedded first and the REPL only cancels the current query.
+	ctx := context.Background()
+	if !*embedMode && !*reindex && !*replMode {
+		var stop context.CancelFunc
+		ctx, stop = signal.NotifyContext(ctx, os.Interrupt)
+		defer stop()
+	}
+
+	if *modelList {
+		models, err := backend.Models(ctx)
+		if err != nil {
+			fatal("failed to list models", "err", err)
+		}
+		for _, m := range models {
+			fmt.Println(m)
+		}
+	} else if *embedMode || *reindex {
 
 		var paths []string
-		for scanner.Scan() {
-			paths = append(paths, scanner.Text())
+		if *reindex {
+			// Overwrite the embeddings of every source that still exists
+			paths, err = indexedSources()
+			if err != nil {
+				fatal("failed to read index", "err", err)
+			}
+			forceEmbed = true
+		} else if *stdinContent || flag.Arg(0) == "-" {
+			if *dryRun {
+				fatal("-dry-run can't be used with a piped document, it is saved before it is embedded")
+			}
+
+			// Keep the piped document as a file so it can be used as context
+			// and re-embedded like any other source
+			path, err := saveStdinContent(filepath.Join(dataDir, "stdin"), *docName)
+			if err != nil {
+				fatal("failed to save stdin content", "err", err)
+			}
+			slog.Debug("saved stdin content", "path", path)
+			paths = []string{path}
+		} else if len(dirs) > 0 {
+			// Walk the given directory roots
+			for _, d := range dirs {
+				found, err := walkDir(d, strings.Split(includeGlob, ","))
+				if err != nil {
+					fatal("failed to walk directory", "dir", d, "err", err)
+				}
+				paths = append(paths, found...)
+			}
+		} else if !*manifest {
+			// Accept list of paths from stdin
+			paths, err = readLines(os.Stdin)
+			if err != nil {
+				fatal("failed to read input", "err", err)
+			}
 		}
 
-		if err := scanner.Err(); err != nil {
-			fmt.Fprintf(os.Stderr, "Error reading input: %v\n", err)
-			os.Exit(1)
+		targets := defaultTargets(paths)
+		if *manifest {
+			// Every file can come with its own chunking settings
+			targets, err = readManifest(os.Stdin)
+			if err != nil {
+				fatal("failed to read manifest", "err", err)
+			}
+		}
+		targets = uniqueTargets(targets)
+
+		if embedWorkers > 64 {
+			slog.Warn("CCRAG_EMBED_WORKERS is high, the server will likely be overloaded", "workers", embedWorkers)
 		}
 
-		maxWorkers := 4
-		limiter := make(chan bool, maxWorkers)
+		if *dedupeGlobal {
+			globalChunks = newChunkSet()
+		}
+
+		// Up to date files are always skipped, -force would embed them all
+		if *incremental && forceEmbed {
+			fatal("-incremental only embeds new and changed files, it can't be used with -force")
+		}
+
+		if *dryRun {
+			dryRunEmbed(targets)
+			return
+		}
+
+		var interrupted atomic.Bool
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		restoreInterrupt := catchInterrupt(&interrupted, cancel)
 
-		for _, p := range paths {
+		limiter := make(chan bool, embedWorkers)
+		progress := newEmbedProgress(len(targets))
+		var wg sync.WaitGroup
+
+		started := 0
+		for _, t := range targets {
 			limiter <- true
+			// Stop handing out files but let the running workers finish
+			if interrupted.Load() {
+				break
+			}
+			started++
+			wg.Add(1)
 
 			go func() {
-				name := cc.FileName(p)
-				embedFileName := name + "." + embedFormat
-				embedFilePath := filepath.Join(embedDir, embedFileName)
+				defer wg.Done()
 
-				if *verbose {
-					fmt.Printf("[D] Embedding: %s\n", p)
-				}
+				slog.Debug("embedding", "path", t.Path, "chunk_size", t.ChunkSize, "strategy", t.Strategy)
 
-				err := embedPath(p, embedFilePath)
+				// Only -incremental tells added and updated sources apart,
+				// looking up the previous embeddings decodes them once more
+				existed := false
+				if *incremental {
+					_, getErr := store.Get(t.Path)
+					existed = getErr == nil
+				}
+				err := embedPath(ctx, t)
+				if err == nil && *incremental {
+					progress.embedded(t.Path, existed)
+				}
 				defer func() { <-limiter }()
-				if err != nil {
-					fmt.Printf("[!] Error embedding file: %s\n", err)
+				progress.update(err)
+				if errors.Is(err, errSkipped) {
+					slog.Debug("skipping", "reason", err)
+					return
+				}
+				if ctx.Err() != nil {
+					slog.Debug("abandoned file", "path", t.Path)
+					return
+				}
+				if err != nil && !errors.Is(err, errUpToDate) {
+					slog.Error("failed to embed file", "err", err)
 					return
 				}
 			}()
 		}
 
-	} else if *query != "" {
-		embUserQuery, err := embed(*query)
-		if err != nil {
-			log.Fatal(err)
+		wg.Wait()
+		restoreInterrupt()
+		progress.summary()
+		if *incremental {
+			progress.changes()
 		}
 
-		if len(embUserQuery.Embeddings) == 0 {
-			fmt.Printf("[!] Failed to create embedding for user query. %v\n", embUserQuery.Embeddings)
-			os.Exit(1)
+		if interrupted.Load() {
+			slog.Warn("embedding interrupted", "not_started", len(targets)-started)
+			store.Close()
+			os.Exit(exitError)
 		}
 
-		embedFiles, err := filepath.Glob(filepath.Join(embedDir, "*."+embedFormat))
+	} else if *listMode {
+		if err := listEmbeddings(*verbose); err != nil {
+			fatal(err.Error())
+		}
+	} else if *pruneMode {
+		if err := pruneEmbeddings(*dryRun); err != nil {
+			fatal(err.Error())
+		}
+	} else if *rmSource != "" || *rmName != "" {
+		var err error
+		if *rmName != "" {
+			err = removeEmbedding(*rmName, true)
+		} else {
+			err = removeEmbedding(*rmSource, false)
+		}
 		if err != nil {
-			log.Fatal(err)
+			fatal(err.Error())
 		}
+	} else if *checkMode {
+		if err := checkEmbeddings(); err != nil {
+			fatal(err.Error())
+		}
+	} else if *statsMode {
+		if err := printStats(embedDir); err != nil {
+			fatal(err.Error())
+		}
+	} else if *dedupMode {
+		index, err := loadIndex()
+		if err != nil {
+			fatal(err.Error())
+		}
+		dedupReport(index, dedupThreshold)
+	} else if *evalFile != "" {
+		index := loadQueryIndex()
+		if err := runEval(ctx, index, *evalFile, maxResults); err != nil {
+			fatal(err.Error())
+		}
+	} else if *serveMode {
+		index := loadQueryIndex()
 
-		scores := []ScoredResult{}
-
-		for _, file := range embedFiles {
-			data, err := os.ReadFile(file)
-			if err != nil {
-				log.Fatal(err)
-			}
-
-			var embNote EmbeddingFile
-			if err := json.Unmarshal(data, &embNote); err != nil {
-				log.Fatal(err)
-			}
-
-			if len(embNote.Embeddings) == 0 {
-				fmt.Printf("[!] Stored note embedding is empty. %s\n", file)
-				continue
-			}
-
-			var score float64
-			for _, emb := range embNote.Embeddings {
-				score += cosineSimilarity(embUserQuery.Embeddings[0], emb)
+		slog.Info("serving", "files", len(index), "addr", *addr)
+		if err := serve(ctx, *addr, index); err != nil {
+			fatal(err.Error())
+		}
+	} else if *watchMode {
+		// Watch the sources already in the index and any paths piped in
+		var paths []string
+		err := store.Walk(func(name string, embFile EmbeddingFile, err error) error {
+			if err == nil {
+				paths = append(paths, embFile.Source)
 			}
-			score /= float64(len(embNote.Embeddings))
+			return nil
+		})
+		if err != nil {
+			fatal(err.Error())
+		}
 
-			if *verbose {
-				fmt.Printf("[D] Scoring file: %s, %f\n", file, score)
+		if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice == 0 {
+			stdinPaths, err := readLines(os.Stdin)
+			if err != nil {
+				fatal("failed to read input", "err", err)
 			}
+			paths = append(paths, stdinPaths...)
+		}
 
-			scores = append(scores, ScoredResult{
-				Score: score,
-				Path:  embNote.Source,
-			})
-
-			// fmt.Printf("[D] Computed score for %s %f\n", file, score)
+		if len(paths) == 0 {
+			fatal("nothing to watch, embed some files first or pipe paths over stdin")
 		}
 
-		// fmt.Printf("[D] Total scored files: %d\n", len(scores))
-		slices.SortFunc(scores, func(a, b ScoredResult) int {
-			// The scores are in the range [0, 1], so scale them to get non-zero
-			// integers for comparison.
-			return int((100.0*a.Score - 100.0*b.Score))
-		})
+		watch(ctx, paths)
+	} else if *replMode {
+		index := loadQueryIndex()
 
-		// Take the N best-scoring chunks
-		selectedScores := []ScoredResult{}
-		for i := len(scores) - 1; i > len(scores)-(maxResults+1); i-- {
-			selectedScores = append(selectedScores, scores[i])
+		if err := repl(ctx, index, os.Stdin, opts); err != nil {
+			fatal(err.Error())
 		}
+	} else if *batch {
+		index := loadQueryIndex()
 
-		// Print best matches and exit
-		if *similarityOnly {
-			for _, v := range selectedScores {
-				fmt.Println(v.Path)
+		// Read one query per line, loading the index only once for all of them
+		scanner := bufio.NewScanner(os.Stdin)
+		first := true
+		failed := false
+		for scanner.Scan() {
+			q := strings.TrimSpace(scanner.Text())
+			if q == "" {
+				continue
 			}
-			os.Exit(0)
-		}
 
-		// Concat selected chunks into context to prepend to the LLM prompt
-		context := ""
-		for _, v := range selectedScores {
-			if *verbose {
-				fmt.Printf("[D] Selected file: %s %f\n", v.Path, v.Score)
+			// JSON Lines carry their query, no delimiter is needed
+			if !first && !opts.jsonl {
+				fmt.Println(batchDelimiter)
 			}
+			first = false
 
-			data, err := os.ReadFile(v.Path)
-			if err != nil {
-				log.Fatal(err)
+			err := runQuery(ctx, index, q, opts)
+			if ctx.Err() != nil {
+				fatal("interrupted")
+			}
+			if errors.Is(err, errNoResults) {
+				slog.Warn(err.Error(), "query", q)
+			} else if err != nil {
+				slog.Error("query failed", "query", q, "err", err)
+				failed = true
 			}
-			context += string(data) + "\n"
 		}
 
-		// Make a request to an LLM with context of the note appended to the prompt
-		prompt := fmt.Sprintf(`Use the below information provided in org-mode markdown to answer the subsequent question. Do not offer any helpful advice! If can not be derived from provided Information use your best take to answer the question. 
-Information:
-%v
-
-Question: %v`, context, *query)
-
-		// fmt.Printf("[D] Prompt: %s\n", prompt)
-
-		url := ollamaAddress + "/api/generate"
-		payload := map[string]interface{}{
-			"model":  llmModel,
-			"prompt": prompt,
-			"stream": false,
+		if err := scanner.Err(); err != nil {
+			fatal("failed to read input", "err", err)
 		}
-		jsonPayload, err := json.Marshal(payload)
-		if err != nil {
-			log.Fatal(err)
+		if failed {
+			os.Exit(exitError)
 		}
-
-		resp, err := client.Post(url, "application/json", bytes.NewBuffer(jsonPayload))
-		if err != nil {
-			log.Fatal(err)
+	} else if *reset && *query == "" {
+		if err := resetSession(sessionFile); err != nil {
+			fatal("failed to reset session", "err", err)
 		}
-		defer resp.Body.Close()
-
-		ollamaResp := OllamaResponse{}
+	} else if *query != "" {
+		if *reset {
+			if err := resetSession(sessionFile); err != nil {
+				fatal("failed to reset session", "err", err)
+			}
+		}
+		opts.sessionFile = sessionFile
 
-		if err := json.NewDecoder(resp.Body).Decode(&ollamaResp); err != nil {
-			log.Fatal(err)
+		var index []EmbeddingFile
+		if len(contextFiles) == 0 {
+			index = loadQueryIndex()
 		}
 
-		fmt.Println(ollamaResp.Response)
+		err = runQuery(ctx, index, *query, opts)
+		if errors.Is(err, errNoResults) {
+			slog.Warn(err.Error())
+			os.Exit(exitNoResults)
+		}
+		if err != nil {
+			fatal(err.Error())
+		}
 	} else {
-		flag.PrintDefaults()
-		os.Exit(1)
+		flag.Usage()
+		os.Exit(exitError)
 	}
 
 }
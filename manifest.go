@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"path/filepath"
+)
+
+// embedTarget is a source file to embed along with the chunking settings it
+// is embedded with.
+type embedTarget struct {
+	Path      string `json:"path"`
+	ChunkSize int    `json:"chunk_size"`
+	Strategy  string `json:"strategy"`
+}
+
+// defaultTargets returns targets embedding paths with the chunking settings
+// of CCRAG_WORDS_PER_CHUNK and CCRAG_CHUNK_STRATEGY.
+func defaultTargets(paths []string) []embedTarget {
+	targets := make([]embedTarget, len(paths))
+	for i, p := range paths {
+		targets[i] = embedTarget{Path: p, ChunkSize: chunkSize, Strategy: chunkStrategy}
+	}
+	return targets
+}
+
+// uniqueTargets returns the targets without repeats of a path, the first
+// one is kept. Workers embedding the same path at once would race writing
+// its embedding file.
+func uniqueTargets(targets []embedTarget) []embedTarget {
+	seen := map[string]bool{}
+	unique := []embedTarget{}
+	for _, t := range targets {
+		p := filepath.Clean(t.Path)
+		if seen[p] {
+			slog.Debug("skipping repeated path", "path", t.Path)
+			continue
+		}
+		seen[p] = true
+		unique = append(unique, t)
+	}
+	return unique
+}
+
+// readManifest reads a JSON list of files to embed, each with a path and
+// optionally a chunk_size and strategy. Omitted settings fall back to the
+// global ones.
+func readManifest(r io.Reader) ([]embedTarget, error) {
+	var targets []embedTarget
+	if err := json.NewDecoder(r).Decode(&targets); err != nil {
+		return nil, fmt.Errorf("invalid manifest, %w", err)
+	}
+
+	for i, t := range targets {
+		if t.Path == "" {
+			return nil, fmt.Errorf("manifest entry %d has no path", i)
+		}
+		if t.ChunkSize < 0 {
+			return nil, fmt.Errorf("manifest entry %s has a negative chunk_size %d", t.Path, t.ChunkSize)
+		}
+		if t.ChunkSize == 0 {
+			targets[i].ChunkSize = chunkSize
+		}
+		if t.Strategy == "" {
+			targets[i].Strategy = chunkStrategy
+		}
+	}
+
+	return targets, nil
+}
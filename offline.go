@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"io"
+)
+
+// offlineDims is the number of dimensions of offline embeddings.
+const offlineDims = 256
+
+// offlineModel is the model offline embeddings are recorded with, so they
+// are never mixed up with vectors of a real model.
+const offlineModel = "offline"
+
+// offlineBackend needs no server. Embeddings hash the words of the input
+// into a fixed number of buckets, so equal texts always get equal vectors
+// and texts sharing words score higher. Generate echoes the prompt. It
+// makes the whole pipeline deterministic for trying out and debugging
+// chunking and scoring settings.
+type offlineBackend struct{}
+
+func (offlineBackend) Embed(_ context.Context, inputs []string) (EmbeddingResponse, error) {
+	embeddings := make([][]float64, len(inputs))
+	for i, input := range inputs {
+		vec := make([]float64, offlineDims)
+		for _, word := range tokenize(input) {
+			h := fnv.New32a()
+			h.Write([]byte(word))
+			vec[h.Sum32()%offlineDims]++
+		}
+		embeddings[i] = vec
+	}
+
+	return EmbeddingResponse{Model: offlineModel, Embeddings: embeddings}, nil
+}
+
+func (offlineBackend) Generate(_ context.Context, prompt string, out io.Writer) (OllamaResponse, error) {
+	if out != nil {
+		if _, err := io.WriteString(out, prompt); err != nil {
+			return OllamaResponse{}, err
+		}
+	}
+
+	return OllamaResponse{Model: llmModel, Response: prompt, Done: true}, nil
+}
+
+func (offlineBackend) Models(_ context.Context) ([]string, error) {
+	return []string{offlineModel, embedModel, llmModel}, nil
+}
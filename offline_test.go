@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	ix "github.com/kif11/rag/pkg/index"
+)
+
+func TestEmbedChunksOffline(t *testing.T) {
+	inputs := []string{"red apples", "green pears", "red apples", "blue plums", "green pears"}
+
+	for _, batch := range []int{0, 1, 2, 32} {
+		e := embedder{backend: offlineBackend{}, batch: batch}
+
+		embeddings, err := e.embedChunks(context.Background(), inputs)
+		if err != nil {
+			t.Fatalf("batch %d: %v", batch, err)
+		}
+		if len(embeddings) != len(inputs) {
+			t.Fatalf("batch %d: got %d embeddings for %d inputs", batch, len(embeddings), len(inputs))
+		}
+
+		// Batches must keep the embeddings in the order of the inputs
+		for i, vec := range embeddings {
+			if len(vec) != offlineDims {
+				t.Errorf("batch %d: embedding %d has %d dimensions, want %d", batch, i, len(vec), offlineDims)
+			}
+		}
+		if s := ix.CosineSimilarity(embeddings[0], embeddings[2]); math.Abs(s-1) > 1e-9 {
+			t.Errorf("batch %d: equal inputs score %v, want 1", batch, s)
+		}
+		if s := ix.CosineSimilarity(embeddings[1], embeddings[4]); math.Abs(s-1) > 1e-9 {
+			t.Errorf("batch %d: equal inputs score %v, want 1", batch, s)
+		}
+	}
+}
+
+func TestSearchOffline(t *testing.T) {
+	e := embedder{backend: offlineBackend{}}
+
+	sources := map[string]string{
+		"fruit.txt":   "apples pears and plums from the orchard",
+		"weather.txt": "rain and wind over the harbor",
+		"music.txt":   "guitar chords and a drum loop",
+	}
+
+	files := []ix.EmbeddingFile{}
+	for source, text := range sources {
+		res, err := e.embed(context.Background(), text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, ix.EmbeddingFile{Source: source, Embeddings: res.Embeddings, Model: res.Model})
+	}
+
+	res, err := e.embed(context.Background(), "orchard apples")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Model != offlineModel {
+		t.Errorf("offline vectors are recorded as model %q, want %q", res.Model, offlineModel)
+	}
+
+	index := &ix.Index{Files: files}
+	results := index.Search(res.Embeddings[0], len(files)+1)
+	if len(results) != len(files) {
+		t.Fatalf("got %d results for %d files", len(results), len(files))
+	}
+	if results[0].Path != "fruit.txt" {
+		t.Errorf("best result is %s, want fruit.txt", results[0].Path)
+	}
+}
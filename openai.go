@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+type OpenAIEmbeddingResponse struct {
+	Model string `json:"model"`
+	Data  []struct {
+		Index     int       `json:"index"`
+		Embedding []float64 `json:"embedding"`
+	} `json:"data"`
+	Usage struct {
+		PromptTokens int `json:"prompt_tokens"`
+	} `json:"usage"`
+}
+
+type OpenAIChatResponse struct {
+	Model   string `json:"model"`
+	Created int64  `json:"created"`
+	Choices []struct {
+		Message struct {
+			Content string `json:"content"`
+		} `json:"message"`
+		Delta struct {
+			Content string `json:"content"`
+		} `json:"delta"`
+		FinishReason string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+	} `json:"usage"`
+}
+
+// openAIBackend talks to any server implementing the OpenAI embeddings and
+// chat completions API, such as vLLM or hosted providers.
+type openAIBackend struct{}
+
+func (b openAIBackend) post(ctx context.Context, path string, payload any) (*http.Response, error) {
+	jsonData, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, openAIAddress+path, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	return b.do(req)
+}
+
+func (openAIBackend) do(req *http.Request) (*http.Response, error) {
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer closeBody(resp.Body)
+		return nil, &statusError{
+			code: resp.StatusCode,
+			msg:  fmt.Sprintf("request failed with status %d, %s", resp.StatusCode, getBodyAsText(resp.Body)),
+		}
+	}
+
+	return resp, nil
+}
+
+func (b openAIBackend) Embed(ctx context.Context, inputs []string) (EmbeddingResponse, error) {
+	payload := map[string]interface{}{
+		"model": embedModel,
+		"input": inputs,
+	}
+
+	resp, err := b.post(ctx, "/v1/embeddings", payload)
+	if err != nil {
+		return EmbeddingResponse{}, err
+	}
+	defer closeBody(resp.Body)
+
+	var result OpenAIEmbeddingResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return EmbeddingResponse{}, err
+	}
+
+	embeddings := make([][]float64, len(result.Data))
+	for _, d := range result.Data {
+		if d.Index < 0 || d.Index >= len(embeddings) {
+			return EmbeddingResponse{}, fmt.Errorf("embedding index %d out of range", d.Index)
+		}
+		embeddings[d.Index] = d.Embedding
+	}
+
+	return EmbeddingResponse{
+		Model:           result.Model,
+		Embeddings:      embeddings,
+		PromptEvalCount: result.Usage.PromptTokens,
+	}, nil
+}
+
+func (b openAIBackend) Generate(ctx context.Context, prompt string, out io.Writer) (OllamaResponse, error) {
+	payload := map[string]interface{}{
+		"model": llmModel,
+		"messages": []map[string]string{
+			{"role": "user", "content": prompt},
+		},
+		"stream": out != nil,
+	}
+	if genOptions.Temperature != nil {
+		payload["temperature"] = *genOptions.Temperature
+	}
+	if genOptions.TopP != nil {
+		payload["top_p"] = *genOptions.TopP
+	}
+	if genOptions.NumPredict != nil {
+		payload["max_tokens"] = *genOptions.NumPredict
+	}
+	if genOptions.Seed != nil {
+		payload["seed"] = *genOptions.Seed
+	}
+
+	resp, err := b.post(ctx, "/v1/chat/completions", payload)
+	if err != nil {
+		return OllamaResponse{}, err
+	}
+	defer closeBody(resp.Body)
+
+	if out == nil {
+		var result OpenAIChatResponse
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			return OllamaResponse{}, err
+		}
+		if len(result.Choices) == 0 {
+			return OllamaResponse{}, fmt.Errorf("chat completion returned no choices")
+		}
+
+		return OllamaResponse{
+			Model:           result.Model,
+			Response:        result.Choices[0].Message.Content,
+			Done:            true,
+			DoneReason:      result.Choices[0].FinishReason,
+			PromptEvalCount: result.Usage.PromptTokens,
+			EvalCount:       result.Usage.CompletionTokens,
+		}, nil
+	}
+
+	// Streamed completions are sent as server-sent events, one JSON chunk
+	// per "data:" line, terminated by "data: [DONE]".
+	ollamaResp := OllamaResponse{Model: llmModel}
+	var answer strings.Builder
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		if line == "[DONE]" {
+			ollamaResp.Done = true
+			break
+		}
+
+		var part OpenAIChatResponse
+		if err := json.Unmarshal([]byte(line), &part); err != nil {
+			return OllamaResponse{}, err
+		}
+		if len(part.Choices) == 0 {
+			continue
+		}
+
+		if _, err := io.WriteString(out, part.Choices[0].Delta.Content); err != nil {
+			return OllamaResponse{}, err
+		}
+		answer.WriteString(part.Choices[0].Delta.Content)
+
+		if part.Choices[0].FinishReason != "" {
+			ollamaResp.DoneReason = part.Choices[0].FinishReason
+			ollamaResp.Done = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return OllamaResponse{}, err
+	}
+
+	// A stream cut off before the last chunk holds a partial answer
+	if !ollamaResp.Done {
+		return OllamaResponse{}, fmt.Errorf("generation failed, the response stream ended early: %w", io.ErrUnexpectedEOF)
+	}
+	ollamaResp.Response = answer.String()
+
+	return ollamaResp, nil
+}
+
+func (b openAIBackend) Models(ctx context.Context) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, openAIAddress+"/v1/models", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := b.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer closeBody(resp.Body)
+
+	var result struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	models := []string{}
+	for _, m := range result.Data {
+		models = append(models, m.ID)
+	}
+	return models, nil
+}
@@ -0,0 +1,208 @@
+package index
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Formats lists the file formats embedding files are written in.
+var Formats = []string{"json", "bin"}
+
+// Extensions lists the extensions of all embedding files, every format
+// either plain or gzip compressed.
+func Extensions() []string {
+	exts := []string{}
+	for _, format := range Formats {
+		exts = append(exts, format, format+".gz")
+	}
+	return exts
+}
+
+// FindFiles returns the paths of all embedding files in dir and its
+// subdirectories, which hold the files of sources named by their path. It
+// finds none when dir doesn't exist.
+func FindFiles(dir string) ([]string, error) {
+	paths := []string{}
+	// A collection nothing was embedded into yet has no directory
+	if _, err := os.Stat(dir); errors.Is(err, fs.ErrNotExist) {
+		return paths, nil
+	}
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		for _, ext := range Extensions() {
+			if strings.HasSuffix(d.Name(), "."+ext) {
+				paths = append(paths, path)
+				break
+			}
+		}
+		return nil
+	})
+	return paths, err
+}
+
+// ReadFile loads an embedding file, detecting its format and compression
+// by the file extension.
+func ReadFile(path string) (EmbeddingFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return EmbeddingFile{}, err
+	}
+
+	name := path
+	if filepath.Ext(name) == ".gz" {
+		if data, err = Gunzip(data); err != nil {
+			return EmbeddingFile{}, fmt.Errorf("%s: %w", path, err)
+		}
+		name = strings.TrimSuffix(name, ".gz")
+	}
+
+	var embFile EmbeddingFile
+	if filepath.Ext(name) == ".bin" {
+		embFile, err = DecodeBinary(data)
+	} else {
+		err = json.Unmarshal(data, &embFile)
+	}
+	if err != nil {
+		return EmbeddingFile{}, fmt.Errorf("%s: %w", path, err)
+	}
+
+	// Readers work with floats, the index quantizes again where it pays off
+	return embFile.Dequantize(), nil
+}
+
+// Gunzip decompresses gzip compressed data.
+func Gunzip(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+// EncodeBinary encodes f in the binary format. It starts with a
+// little-endian uint32 holding the length of a JSON header with everything
+// but the vectors. The header is followed by the uint32 number of vectors,
+// the uint32 dimension and finally the vector components as little-endian
+// float32. The components of a quantized file are written as int8, its
+// header holds the scales of the vectors.
+func EncodeBinary(f EmbeddingFile) ([]byte, error) {
+	meta := f
+	meta.Embeddings, meta.Quantized = nil, nil
+	header, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	count, dims, size := f.Len(), 0, 4
+	if count > 0 {
+		dims = len(f.Vector(0))
+	}
+	if f.Quantized != nil {
+		size = 1
+	}
+
+	buf := make([]byte, 0, 4+len(header)+8+size*count*dims)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(header)))
+	buf = append(buf, header...)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(count))
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(dims))
+
+	for i := range count {
+		if f.Quantized != nil {
+			if len(f.Quantized[i]) != dims {
+				return nil, fmt.Errorf("chunk %d has %d dimensions, expected %d", i, len(f.Quantized[i]), dims)
+			}
+			for _, q := range f.Quantized[i] {
+				buf = append(buf, byte(q))
+			}
+			continue
+		}
+
+		if len(f.Embeddings[i]) != dims {
+			return nil, fmt.Errorf("chunk %d has %d dimensions, expected %d", i, len(f.Embeddings[i]), dims)
+		}
+		for _, v := range f.Embeddings[i] {
+			buf = binary.LittleEndian.AppendUint32(buf, math.Float32bits(float32(v)))
+		}
+	}
+
+	return buf, nil
+}
+
+// DecodeBinary decodes an embedding file written by EncodeBinary.
+func DecodeBinary(data []byte) (EmbeddingFile, error) {
+	if len(data) < 4 {
+		return EmbeddingFile{}, errors.New("truncated binary embedding file")
+	}
+	headerLen := int(binary.LittleEndian.Uint32(data))
+	data = data[4:]
+
+	if len(data) < headerLen+8 {
+		return EmbeddingFile{}, errors.New("truncated binary embedding file")
+	}
+
+	var embFile EmbeddingFile
+	if err := json.Unmarshal(data[:headerLen], &embFile); err != nil {
+		return EmbeddingFile{}, err
+	}
+	data = data[headerLen:]
+
+	count := int(binary.LittleEndian.Uint32(data))
+	dims := int(binary.LittleEndian.Uint32(data[4:]))
+	data = data[8:]
+
+	// Scales in the header mark a quantized file
+	if embFile.Scales != nil {
+		if len(embFile.Scales) != count {
+			return EmbeddingFile{}, fmt.Errorf("expected %d scales, got %d", count, len(embFile.Scales))
+		}
+		if len(data) != count*dims {
+			return EmbeddingFile{}, fmt.Errorf("expected %d quantized vectors of %d dimensions, got %d bytes", count, dims, len(data))
+		}
+
+		embFile.Quantized = make([][]int8, count)
+		for i := range embFile.Quantized {
+			q := make([]int8, dims)
+			for j := range q {
+				q[j] = int8(data[j])
+			}
+			embFile.Quantized[i] = q
+			data = data[dims:]
+		}
+		return embFile, nil
+	}
+
+	if len(data) != 4*count*dims {
+		return EmbeddingFile{}, fmt.Errorf("expected %d vectors of %d dimensions, got %d bytes", count, dims, len(data))
+	}
+
+	embFile.Embeddings = make([][]float64, count)
+	for i := range embFile.Embeddings {
+		emb := make([]float64, dims)
+		for j := range emb {
+			emb[j] = float64(math.Float32frombits(binary.LittleEndian.Uint32(data)))
+			data = data[4:]
+		}
+		embFile.Embeddings[i] = emb
+	}
+
+	return embFile, nil
+}
@@ -0,0 +1,77 @@
+package index
+
+import (
+	"bytes"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestBinaryQuantizedRoundTrip(t *testing.T) {
+	f := EmbeddingFile{Source: "notes.txt", Model: "model"}
+	for i := range 4 {
+		emb := make([]float64, 64)
+		for j := range emb {
+			emb[j] = math.Sin(float64(i*len(emb) + j))
+		}
+		f.Embeddings = append(f.Embeddings, emb)
+	}
+	q := f.Quantize()
+
+	data, err := EncodeBinary(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte(`"quantized"`)) {
+		t.Error("quantized vectors are written into the JSON header")
+	}
+
+	plain, err := EncodeBinary(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) >= len(plain) {
+		t.Errorf("quantized file takes %d bytes, not less than %d as float32", len(data), len(plain))
+	}
+
+	got, err := DecodeBinary(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Source != f.Source || got.Model != f.Model {
+		t.Errorf("decoded source %q model %q, want %q %q", got.Source, got.Model, f.Source, f.Model)
+	}
+	if got.Embeddings != nil {
+		t.Error("decoded quantized file has float embeddings")
+	}
+	if !slices.Equal(got.Scales, q.Scales) {
+		t.Errorf("decoded scales %v, want %v", got.Scales, q.Scales)
+	}
+	for i := range q.Quantized {
+		if !slices.Equal(got.Quantized[i], q.Quantized[i]) {
+			t.Errorf("decoded vector %d is %v, want %v", i, got.Quantized[i], q.Quantized[i])
+		}
+	}
+
+	// ReadFile converts the vectors back to floats
+	path := filepath.Join(t.TempDir(), "notes.txt.bin")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.Quantized != nil || len(read.Embeddings) != len(f.Embeddings) {
+		t.Fatalf("read %d float embeddings, want %d", len(read.Embeddings), len(f.Embeddings))
+	}
+	for i, emb := range f.Embeddings {
+		for j, v := range emb {
+			if math.Abs(read.Embeddings[i][j]-v) > 0.01 {
+				t.Errorf("embedding %d component %d is %v, want about %v", i, j, read.Embeddings[i][j], v)
+			}
+		}
+	}
+}
@@ -0,0 +1,142 @@
+// Package index implements the vector search of ccrag over embedding files
+// written by the ccrag command, so other programs can query an index
+// without going through the command line.
+package index
+
+import (
+	"math"
+	"strings"
+	"time"
+)
+
+// EmbeddingFile holds the embeddings of the chunks of a single source file.
+type EmbeddingFile struct {
+	Embeddings [][]float64 `json:"embeddings"`
+	ChunkSize  int         `json:"chunk_size"`
+	Source     string      `json:"source"`
+	Model      string      `json:"model"`
+	// ChunkStrategy is the strategy the source was chunked with, empty
+	// for the words strategy.
+	ChunkStrategy string `json:"chunk_strategy,omitempty"`
+	// SourceModTime is the modification time of the source file at the
+	// moment it was embedded. Zero for files written by older versions.
+	SourceModTime time.Time `json:"source_mod_time"`
+	// Normalized is set when the embeddings are scaled to unit length so
+	// their dot product equals cosine similarity.
+	Normalized bool `json:"normalized"`
+	// ChunkIndex maps every embedding to the position of its chunk in the
+	// source when duplicate chunks were left out. Nil when they map 1:1.
+	ChunkIndex []int `json:"chunk_index,omitempty"`
+	// Chunks holds the text of the chunk of every embedding when the text
+	// was stored along with the vectors, nil otherwise.
+	Chunks []string `json:"chunks,omitempty"`
+	// Quantized holds the embeddings as int8 instead of Embeddings when the
+	// file is quantized, vector i scaled by Scales[i].
+	Quantized [][]int8  `json:"quantized,omitempty"`
+	Scales    []float64 `json:"scales,omitempty"`
+}
+
+// ChunkText returns the stored text of the chunks at the positions from
+// start to end in the source, joined. Positions without an embedding, left
+// out as duplicates, are skipped. It is empty when no text is stored.
+func (f EmbeddingFile) ChunkText(start, end int) string {
+	if len(f.Chunks) != f.Len() {
+		return ""
+	}
+
+	var text strings.Builder
+	for i, c := range f.Chunks {
+		if p := f.ChunkPosition(i); p >= start && p <= end {
+			text.WriteString(c)
+		}
+	}
+	return text.String()
+}
+
+// ChunkPosition returns the position in the source of the chunk that
+// produced embedding i.
+func (f EmbeddingFile) ChunkPosition(i int) int {
+	if f.ChunkIndex == nil {
+		return i
+	}
+	return f.ChunkIndex[i]
+}
+
+// ScoredResult is a source file matching a query.
+type ScoredResult struct {
+	Score float64 `json:"score"`
+	Path  string  `json:"path"`
+	// Chunk is the index of the best matching chunk within the source
+	Chunk int `json:"chunk"`
+	// ChunkSize and ChunkStrategy are the chunking settings the source was
+	// embedded with
+	ChunkSize     int    `json:"chunk_size"`
+	ChunkStrategy string `json:"chunk_strategy,omitempty"`
+	// Text is the stored text of the best matching chunk, set when the
+	// source was embedded with its chunk text
+	Text string `json:"text,omitempty"`
+}
+
+// CosineSimilarity calculates cosine similarity (magnitude-adjusted dot
+// product) between two vectors that must be of the same size.
+func CosineSimilarity(a, b []float64) float64 {
+	if len(a) != len(b) {
+		panic("different lengths")
+	}
+
+	var aMag, bMag, dotProduct float64
+	for i := 0; i < len(a); i++ {
+		aMag += a[i] * a[i]
+		bMag += b[i] * b[i]
+		dotProduct += a[i] * b[i]
+	}
+	return dotProduct / (math.Sqrt(aMag) * math.Sqrt(bMag))
+}
+
+// DotProduct calculates the dot product of two vectors that must be of the
+// same size. For unit length vectors it equals their cosine similarity.
+func DotProduct(a, b []float64) float64 {
+	if len(a) != len(b) {
+		panic("different lengths")
+	}
+
+	var dot float64
+	for i := 0; i < len(a); i++ {
+		dot += a[i] * b[i]
+	}
+	return dot
+}
+
+// EuclideanSimilarity turns the euclidean distance between two vectors that
+// must be of the same size into a similarity, 1 for equal vectors falling
+// towards 0 as they grow apart.
+func EuclideanSimilarity(a, b []float64) float64 {
+	if len(a) != len(b) {
+		panic("different lengths")
+	}
+
+	var sum float64
+	for i := 0; i < len(a); i++ {
+		d := a[i] - b[i]
+		sum += d * d
+	}
+	return 1 / (1 + math.Sqrt(sum))
+}
+
+// Normalize returns a copy of v scaled to unit length.
+func Normalize(v []float64) []float64 {
+	var mag float64
+	for _, x := range v {
+		mag += x * x
+	}
+	mag = math.Sqrt(mag)
+
+	n := make([]float64, len(v))
+	if mag == 0 {
+		return n
+	}
+	for i, x := range v {
+		n[i] = x / mag
+	}
+	return n
+}
@@ -0,0 +1,41 @@
+package index
+
+import (
+	"math"
+	"testing"
+)
+
+func TestCosineSimilarity(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b []float64
+		want float64
+	}{
+		{"identical", []float64{1, 2, 3}, []float64{1, 2, 3}, 1},
+		{"scaled", []float64{1, 2, 3}, []float64{2, 4, 6}, 1},
+		{"orthogonal", []float64{1, 0}, []float64{0, 1}, 0},
+		{"opposite", []float64{1, 2, 3}, []float64{-1, -2, -3}, -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CosineSimilarity(tt.a, tt.b); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("CosineSimilarity(%v, %v) = %v, want %v", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHasDims(t *testing.T) {
+	f := EmbeddingFile{Embeddings: [][]float64{{1, 2, 3}, {4, 5, 6}}}
+
+	if !f.HasDims(3) {
+		t.Error("HasDims(3) = false, want true")
+	}
+	if f.HasDims(2) {
+		t.Error("HasDims(2) = true, want false")
+	}
+	if !f.Quantize().HasDims(3) {
+		t.Error("quantized HasDims(3) = false, want true")
+	}
+}
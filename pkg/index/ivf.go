@@ -0,0 +1,204 @@
+package index
+
+import (
+	"cmp"
+	"math"
+	"runtime"
+	"slices"
+	"sync"
+)
+
+// ivfIterations is the number of k-means rounds placing the centroids.
+const ivfIterations = 10
+
+// ivfTrainPerList is the number of sampled vectors per cluster the
+// centroids are trained on, enough to place them without clustering every
+// vector of a large index.
+const ivfTrainPerList = 40
+
+// IVF is an inverted file index, an approximate nearest neighbor index
+// grouping chunk vectors into clusters around centroids. A query only looks
+// at the clusters with the centroids closest to it, so far fewer files are
+// scored than in a full scan at the cost of missing some matches.
+type IVF struct {
+	centroids [][]float64
+	// lists holds the sources with a chunk in every cluster
+	lists [][]string
+	// always holds sources with vectors of another dimension than the
+	// centroids, they are candidates for every query
+	always []string
+}
+
+// vectorRef locates a chunk vector within a set of files.
+type vectorRef struct {
+	file, chunk int
+}
+
+// BuildIVF clusters the chunk vectors of files into about the square root
+// of their number of clusters. It returns nil when there are no vectors.
+func BuildIVF(files []EmbeddingFile) *IVF {
+	refs := []vectorRef{}
+	dims := 0
+	for i, f := range files {
+		for j := range f.Len() {
+			refs = append(refs, vectorRef{i, j})
+			if dims == 0 {
+				dims = len(f.Vector(j))
+			}
+		}
+	}
+	if len(refs) == 0 {
+		return nil
+	}
+
+	k := int(math.Ceil(math.Sqrt(float64(len(refs)))))
+	vector := func(r vectorRef) []float64 {
+		return Normalize(files[r.file].Vector(r.chunk))
+	}
+
+	// Train on vectors spread evenly over the whole index
+	sample := [][]float64{}
+	step := max(1, len(refs)/(k*ivfTrainPerList))
+	for i := 0; i < len(refs); i += step {
+		if v := vector(refs[i]); len(v) == dims {
+			sample = append(sample, v)
+		}
+	}
+
+	ivf := &IVF{centroids: trainCentroids(sample, k)}
+	ivf.lists = make([][]string, len(ivf.centroids))
+
+	// Assign every vector to its closest centroid, a file is listed in
+	// every cluster one of its chunks falls into
+	assigned := make([]int, len(refs))
+	parallelFor(len(refs), func(i int) {
+		v := vector(refs[i])
+		if len(v) != dims {
+			assigned[i] = -1
+			return
+		}
+		assigned[i] = nearest(ivf.centroids, v)
+	})
+
+	for i, r := range refs {
+		source := files[r.file].Source
+		if assigned[i] < 0 {
+			if !slices.Contains(ivf.always, source) {
+				ivf.always = append(ivf.always, source)
+			}
+			continue
+		}
+
+		list := ivf.lists[assigned[i]]
+		// Chunks of a file are consecutive, so repeats are at the end
+		if len(list) == 0 || list[len(list)-1] != source {
+			ivf.lists[assigned[i]] = append(list, source)
+		}
+	}
+
+	return ivf
+}
+
+// Lists returns the number of clusters of the index.
+func (ivf *IVF) Lists() int {
+	return len(ivf.centroids)
+}
+
+// Candidates returns the sources with a chunk in one of the probes
+// clusters closest to the query vector. More probes find more of the true
+// matches but leave more files to score.
+func (ivf *IVF) Candidates(queryVec []float64, probes int) map[string]bool {
+	q := Normalize(queryVec)
+
+	order := make([]int, len(ivf.centroids))
+	scores := make([]float64, len(ivf.centroids))
+	for i, c := range ivf.centroids {
+		order[i] = i
+		if len(c) == len(q) {
+			scores[i] = DotProduct(q, c)
+		} else {
+			scores[i] = math.Inf(-1)
+		}
+	}
+	slices.SortFunc(order, func(a, b int) int {
+		return cmp.Compare(scores[b], scores[a])
+	})
+
+	candidates := map[string]bool{}
+	for _, c := range order[:min(probes, len(order))] {
+		for _, source := range ivf.lists[c] {
+			candidates[source] = true
+		}
+	}
+	for _, source := range ivf.always {
+		candidates[source] = true
+	}
+	return candidates
+}
+
+// trainCentroids places k unit length centroids among the unit length
+// vectors with spherical k-means, starting from vectors spread over the
+// sample. Fewer centroids are returned when there are fewer vectors.
+func trainCentroids(sample [][]float64, k int) [][]float64 {
+	k = min(k, len(sample))
+	centroids := make([][]float64, k)
+	for i := range centroids {
+		centroids[i] = slices.Clone(sample[i*len(sample)/k])
+	}
+
+	assigned := make([]int, len(sample))
+	for range ivfIterations {
+		parallelFor(len(sample), func(i int) {
+			assigned[i] = nearest(centroids, sample[i])
+		})
+
+		sums := make([][]float64, k)
+		for i, v := range sample {
+			c := assigned[i]
+			if sums[c] == nil {
+				sums[c] = make([]float64, len(v))
+			}
+			for j, x := range v {
+				sums[c][j] += x
+			}
+		}
+
+		// A centroid nothing was assigned to stays where it is
+		for c, sum := range sums {
+			if sum != nil {
+				centroids[c] = Normalize(sum)
+			}
+		}
+	}
+
+	return centroids
+}
+
+// nearest returns the index of the centroid most similar to the unit length
+// vector v.
+func nearest(centroids [][]float64, v []float64) int {
+	best, bestScore := 0, math.Inf(-1)
+	for i, c := range centroids {
+		if s := DotProduct(c, v); s > bestScore {
+			best, bestScore = i, s
+		}
+	}
+	return best
+}
+
+// parallelFor calls f for every i from 0 to n-1, spread over as many
+// goroutines as there are CPUs.
+func parallelFor(n int, f func(i int)) {
+	workers := runtime.NumCPU()
+	var wg sync.WaitGroup
+	for w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := w; i < n; i += workers {
+				f(i)
+			}
+		}()
+	}
+	wg.Wait()
+}
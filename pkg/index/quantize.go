@@ -0,0 +1,106 @@
+package index
+
+import "math"
+
+// Len returns the number of embeddings of the file, quantized or not.
+func (f EmbeddingFile) Len() int {
+	if f.Quantized != nil {
+		return len(f.Quantized)
+	}
+	return len(f.Embeddings)
+}
+
+// HasDims reports whether every embedding of the file has n dimensions.
+// Files embedded by another model can't be compared with vectors of n
+// dimensions.
+func (f EmbeddingFile) HasDims(n int) bool {
+	for i := range f.Len() {
+		dims := 0
+		if f.Quantized != nil {
+			dims = len(f.Quantized[i])
+		} else {
+			dims = len(f.Embeddings[i])
+		}
+		if dims != n {
+			return false
+		}
+	}
+	return true
+}
+
+// Vector returns embedding i as floats, converting it back when the file
+// is quantized.
+func (f EmbeddingFile) Vector(i int) []float64 {
+	if f.Quantized == nil {
+		return f.Embeddings[i]
+	}
+
+	v := make([]float64, len(f.Quantized[i]))
+	for j, q := range f.Quantized[i] {
+		v[j] = float64(q) * f.Scales[i]
+	}
+	return v
+}
+
+// Quantize returns a copy of f with its embeddings stored as int8, about
+// 8x smaller in memory than float64. Every vector is scaled so its largest
+// component maps to 127.
+func (f EmbeddingFile) Quantize() EmbeddingFile {
+	if f.Quantized != nil {
+		return f
+	}
+
+	f.Quantized = make([][]int8, len(f.Embeddings))
+	f.Scales = make([]float64, len(f.Embeddings))
+	for i, emb := range f.Embeddings {
+		f.Quantized[i], f.Scales[i] = quantizeVector(emb)
+	}
+	f.Embeddings = nil
+	return f
+}
+
+// Dequantize returns a copy of f with its embeddings stored as float64.
+func (f EmbeddingFile) Dequantize() EmbeddingFile {
+	if f.Quantized == nil {
+		return f
+	}
+
+	f.Embeddings = make([][]float64, len(f.Quantized))
+	for i := range f.Quantized {
+		f.Embeddings[i] = f.Vector(i)
+	}
+	f.Quantized, f.Scales = nil, nil
+	return f
+}
+
+func quantizeVector(v []float64) ([]int8, float64) {
+	var maxAbs float64
+	for _, x := range v {
+		maxAbs = max(maxAbs, math.Abs(x))
+	}
+
+	q := make([]int8, len(v))
+	if maxAbs == 0 {
+		return q, 0
+	}
+
+	scale := maxAbs / 127
+	for i, x := range v {
+		q[i] = int8(math.Round(x / scale))
+	}
+	return q, scale
+}
+
+// DotInt8 calculates the dot product of two int8 vectors that must be of
+// the same size.
+func DotInt8(a, b []int8) int32 {
+	if len(a) != len(b) {
+		panic("different lengths")
+	}
+
+	var dot int32
+	for i := range a {
+		dot += int32(a[i]) * int32(b[i])
+	}
+	return dot
+}
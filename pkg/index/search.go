@@ -0,0 +1,212 @@
+package index
+
+import (
+	"cmp"
+	"log/slog"
+	"math"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Index searches a set of embedding files by vector similarity.
+type Index struct {
+	Files []EmbeddingFile
+	// ScoreMode "max" scores a file by its single best matching chunk,
+	// anything else by the mean score of its chunks.
+	ScoreMode string
+	// MinScore drops results scoring below it.
+	MinScore float64
+	// Metric compares vectors by "dot" product or "euclidean" distance,
+	// anything else by cosine similarity. Higher scores are better for
+	// all of them.
+	Metric string
+	// Rescore wraps the vector score of the chunks of a file when set, for
+	// example to blend in keyword matches.
+	Rescore func(f EmbeddingFile, score func(i int) float64) func(i int) float64
+	// IVF, when set, narrows the files scored down to the ones with chunks
+	// in the Probes clusters closest to the query.
+	IVF    *IVF
+	Probes int
+	// PerChunk ranks every chunk on its own instead of whole files, a file
+	// is then part of the results once for every selected chunk.
+	PerChunk bool
+}
+
+// Load reads every embedding file in dir and its subdirectories.
+// Unreadable files and files without embeddings are left out.
+func Load(dir string) (*Index, error) {
+	paths, err := FindFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ix := &Index{}
+	for _, path := range paths {
+		// A single corrupt file shouldn't make the whole index unusable
+		f, err := ReadFile(path)
+		if err != nil {
+			slog.Warn("skipping unreadable embedding file", "file", path, "err", err)
+			continue
+		}
+		if f.Len() > 0 {
+			ix.Files = append(ix.Files, f)
+		}
+	}
+	return ix, nil
+}
+
+// scoreChunks scores every one of n chunks with the score function and
+// combines them into a single file score according to the score mode. It
+// also returns the index of the best matching chunk.
+func (ix *Index) scoreChunks(n int, score func(i int) float64) (float64, int) {
+	var sum float64
+	best, bestChunk := math.Inf(-1), 0
+	for i := range n {
+		s := score(i)
+		sum += s
+		if s > best {
+			best, bestChunk = s, i
+		}
+	}
+
+	if ix.ScoreMode == "max" {
+		return best, bestChunk
+	}
+	return sum / float64(n), bestChunk
+}
+
+// topResults returns up to n best results from scores sorted in ascending
+// order, best first.
+func topResults(scores []ScoredResult, n int) []ScoredResult {
+	start := max(0, len(scores)-n)
+
+	selected := []ScoredResult{}
+	for i := len(scores) - 1; i >= start; i-- {
+		selected = append(selected, scores[i])
+	}
+	return selected
+}
+
+// chunkResult returns the result for file f with the given score, pointing
+// at the chunk of embedding i.
+func chunkResult(f EmbeddingFile, i int, score float64) ScoredResult {
+	pos := f.ChunkPosition(i)
+	return ScoredResult{
+		Score: score,
+		Path:  f.Source,
+		Chunk: pos,
+
+		ChunkSize:     f.ChunkSize,
+		ChunkStrategy: f.ChunkStrategy,
+		Text:          f.ChunkText(pos, pos),
+	}
+}
+
+// Search scores every file of the index against the query vector and
+// returns up to n best results, best first. With an IVF only its
+// candidates are scored, exactly like in a full scan. Files with vectors of
+// another dimension than the query are skipped with a warning.
+func (ix *Index) Search(queryVec []float64, n int) []ScoredResult {
+	scores := []ScoredResult{}
+	normQueryVec := Normalize(queryVec)
+	quantQueryVec, queryScale := quantizeVector(normQueryVec)
+
+	files := ix.Files
+	if ix.IVF != nil {
+		candidates := ix.IVF.Candidates(queryVec, ix.Probes)
+		files = slices.DeleteFunc(slices.Clone(files), func(f EmbeddingFile) bool {
+			return !candidates[f.Source]
+		})
+		slog.Debug("approximate search", "candidates", len(files), "files", len(ix.Files), "probes", ix.Probes)
+	}
+
+	// Vectors of another dimension come from another model, such as files
+	// written before the model was recorded, and can't be compared
+	mismatched := 0
+	files = slices.DeleteFunc(slices.Clone(files), func(f EmbeddingFile) bool {
+		if f.HasDims(len(queryVec)) {
+			return false
+		}
+		slog.Debug("skipping file of another dimension", "path", f.Source, "dims", len(queryVec))
+		mismatched++
+		return true
+	})
+	if mismatched > 0 {
+		slog.Warn("skipping files with embeddings of another dimension than the query, embed them again", "files", mismatched, "dims", len(queryVec))
+	}
+
+	var mu sync.Mutex
+	limiter := make(chan bool, runtime.NumCPU())
+	var wg sync.WaitGroup
+
+	for _, embNote := range files {
+		limiter <- true
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			defer func() { <-limiter }()
+
+			// Normalized embeddings skip recomputing magnitudes for every chunk
+			q, similarity := queryVec, CosineSimilarity
+			cosine := ix.Metric != "dot" && ix.Metric != "euclidean"
+			switch {
+			case ix.Metric == "dot":
+				similarity = DotProduct
+			case ix.Metric == "euclidean":
+				similarity = EuclideanSimilarity
+			case embNote.Normalized:
+				q, similarity = normQueryVec, DotProduct
+			}
+			chunkScore := func(i int) float64 {
+				return similarity(q, embNote.Vector(i))
+			}
+			// Quantized vectors are compared without converting them back
+			if embNote.Quantized != nil && embNote.Normalized && cosine {
+				chunkScore = func(i int) float64 {
+					return float64(DotInt8(quantQueryVec, embNote.Quantized[i])) * queryScale * embNote.Scales[i]
+				}
+			}
+			if ix.Rescore != nil {
+				chunkScore = ix.Rescore(embNote, chunkScore)
+			}
+
+			if ix.PerChunk {
+				results := make([]ScoredResult, embNote.Len())
+				for i := range results {
+					results[i] = chunkResult(embNote, i, chunkScore(i))
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+				scores = append(scores, results...)
+				return
+			}
+
+			score, chunk := ix.scoreChunks(embNote.Len(), chunkScore)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			slog.Debug("scored file", "path", embNote.Source, "score", score, "best_chunk", embNote.ChunkPosition(chunk))
+
+			scores = append(scores, chunkResult(embNote, chunk, score))
+		}()
+	}
+	wg.Wait()
+
+	// Break ties by path so the order doesn't depend on goroutine scheduling
+	slices.SortFunc(scores, func(a, b ScoredResult) int {
+		return cmp.Or(cmp.Compare(a.Score, b.Score), strings.Compare(b.Path, a.Path), cmp.Compare(b.Chunk, a.Chunk))
+	})
+
+	// Drop weak matches so only relevant files are selected
+	scores = slices.DeleteFunc(scores, func(r ScoredResult) bool {
+		return r.Score < ix.MinScore
+	})
+
+	// Take the N best-scoring chunks
+	return topResults(scores, n)
+}
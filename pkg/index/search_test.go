@@ -0,0 +1,75 @@
+package index
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestTopResults(t *testing.T) {
+	// Scores are sorted in ascending order, best last
+	scores := []ScoredResult{
+		{Score: 0.1, Path: "c"},
+		{Score: 0.5, Path: "b"},
+		{Score: 0.9, Path: "a"},
+	}
+
+	tests := []struct {
+		name   string
+		scores []ScoredResult
+		n      int
+		want   []string
+	}{
+		{"fewer than n", scores, 10, []string{"a", "b", "c"}},
+		{"exactly n", scores, 3, []string{"a", "b", "c"}},
+		{"more than n", scores, 2, []string{"a", "b"}},
+		{"zero", scores, 0, []string{}},
+		{"empty", []ScoredResult{}, 10, []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := []string{}
+			for _, r := range topResults(tt.scores, tt.n) {
+				got = append(got, r.Path)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("topResults(n=%d) = %v, want %v", tt.n, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSearchFewerFilesThanResults(t *testing.T) {
+	ix := &Index{Files: []EmbeddingFile{
+		{Source: "far", Embeddings: [][]float64{{0, 1}}},
+		{Source: "near", Embeddings: [][]float64{{1, 0}}},
+		{Source: "middle", Embeddings: [][]float64{{1, 1}}},
+	}}
+
+	results := ix.Search([]float64{1, 0}, 10)
+
+	got := []string{}
+	for _, r := range results {
+		got = append(got, r.Path)
+	}
+	if want := []string{"near", "middle", "far"}; !slices.Equal(got, want) {
+		t.Errorf("Search() = %v, want %v", got, want)
+	}
+	for i := 1; i < len(results); i++ {
+		if results[i].Score > results[i-1].Score {
+			t.Errorf("result %d scores %v, higher than %v before it", i, results[i].Score, results[i-1].Score)
+		}
+	}
+}
+
+func TestSearchSkipsOtherDimensions(t *testing.T) {
+	ix := &Index{Files: []EmbeddingFile{
+		{Source: "match", Embeddings: [][]float64{{1, 0}}},
+		{Source: "legacy", Embeddings: [][]float64{{1, 0, 0}}},
+	}}
+
+	results := ix.Search([]float64{1, 0}, 10)
+	if len(results) != 1 || results[0].Path != "match" {
+		t.Errorf("Search() = %v, want only match", results)
+	}
+}
@@ -0,0 +1,631 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	ix "github.com/kif11/rag/pkg/index"
+)
+
+// batchDelimiter separates the output of consecutive queries in batch mode
+const batchDelimiter = "---"
+
+// queryOptions holds the per invocation settings of query mode.
+type queryOptions struct {
+	similarityOnly bool
+	scores         bool
+	noStream       bool
+	cite           bool
+	json           bool
+	jsonl          bool
+	showPrompt     bool
+	explain        bool
+	// contextOnly prints the context instead of generating an answer
+	contextOnly bool
+	separators  bool
+	// contextFiles replace the search results as context when set
+	contextFiles []string
+	// sessionFile keeps the conversation between runs when set
+	sessionFile string
+}
+
+// queryResponse is the machine readable output of query mode.
+type queryResponse struct {
+	// Query is only set in JSON Lines output, where lines of several
+	// queries follow each other
+	Query    string         `json:"query,omitempty"`
+	Response string         `json:"response"`
+	Sources  []ScoredResult `json:"sources"`
+}
+
+// resultLine is a single search result in JSON Lines output.
+type resultLine struct {
+	Query string `json:"query"`
+	ScoredResult
+}
+
+// printJSON writes v to stdout as indented JSON.
+func printJSON(v any) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// printJSONLines writes every result to stdout as JSON on a line of its
+// own, so consumers can process them as they arrive.
+func printJSONLines(query string, results []ScoredResult) error {
+	encoder := json.NewEncoder(os.Stdout)
+	for _, r := range results {
+		if err := encoder.Encode(resultLine{Query: query, ScoredResult: r}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadIndex reads all embedding files that can be compared with a query.
+// Unreadable and empty files and files embedded with a different model are
+// left out.
+func loadIndex() ([]EmbeddingFile, error) {
+	index := []EmbeddingFile{}
+	modelMismatches, unreadable, otherChunkSize, otherMetric := 0, 0, 0, 0
+	dims := map[int]int{}
+
+	err := store.Walk(func(file string, embNote EmbeddingFile, err error) error {
+		// A single corrupt file shouldn't make the whole index unusable
+		if err != nil {
+			slog.Warn("skipping unreadable embedding file", "err", err)
+			unreadable++
+			return nil
+		}
+
+		if embNote.Len() == 0 {
+			slog.Warn("stored note embedding is empty", "file", file)
+			return nil
+		}
+
+		// Vectors produced by a different model live in a different space,
+		// comparing them to the query is meaningless. Files written before
+		// the model was recorded have no model and are scored as before.
+		if embNote.Model != "" && embNote.Model != vectorModel() {
+			slog.Warn("skipping file embedded with another model", "file", file, "model", embNote.Model, "current", vectorModel())
+			modelMismatches++
+			return nil
+		}
+
+		if embNote.ChunkSize != chunkSize {
+			otherChunkSize++
+		}
+		// Vectors are normalized exactly when they are embedded for cosine
+		if embNote.Normalized != (metric == "cosine") {
+			otherMetric++
+		}
+
+		dims[len(embNote.Vector(0))]++
+
+		// Quantized vectors take an eighth of the memory and are compared
+		// as integers
+		if quantize == "int8" {
+			embNote = embNote.Quantize()
+		}
+
+		index = append(index, embNote)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Most files share the dimension of the model, cached queries with
+	// another one are embedded again
+	indexDims = 0
+	for d, n := range dims {
+		if indexDims == 0 || n > dims[indexDims] {
+			indexDims = d
+		}
+	}
+
+	slog.Debug("loaded index", "files", len(index), "model_mismatches", modelMismatches, "unreadable", unreadable)
+
+	// Clustering pays off once scanning every vector gets slow, it is done
+	// once per load and shared by all queries
+	annIndex = nil
+	if indexKind == "ann" {
+		start := time.Now()
+		annIndex = ix.BuildIVF(index)
+		if annIndex != nil {
+			slog.Debug("built approximate index", "lists", annIndex.Lists(), "took", time.Since(start))
+		}
+	}
+
+	// Mixed chunk sizes still work but chunks differ in granularity
+	if otherChunkSize > 0 {
+		slog.Debug("files embedded with a chunk size other than CCRAG_WORDS_PER_CHUNK, re-embed them with -e -force for a uniform index",
+			"files", otherChunkSize, "chunk_size", chunkSize)
+	}
+
+	// Dot product and euclidean distance rank normalized vectors like cosine
+	// would, cosine scores of unnormalized vectors are computed the slow way
+	if otherMetric > 0 {
+		slog.Warn("files embedded for another CCRAG_METRIC, re-embed them with -e -force to score them by the current one",
+			"files", otherMetric, "metric", metric)
+	}
+
+	return index, nil
+}
+
+// indexDims is the dimension of most vectors loaded by loadIndex.
+var indexDims int
+
+// annIndex narrows down the files searched when CCRAG_INDEX is ann, it is
+// built by loadIndex.
+var annIndex *ix.IVF
+
+// errNoResults is returned by runQuery when no indexed file matched the
+// query.
+var errNoResults = errors.New("no matching files found")
+
+// queryCacheDir holds cached query embeddings, caching is disabled when it
+// is empty.
+var queryCacheDir string
+
+// queryCachePath returns the cache file of the query embedded with the
+// current backend and embedding model.
+func queryCachePath(query string) string {
+	return filepath.Join(queryCacheDir, embedCacheKey(query)+".json")
+}
+
+// embedQuery returns the embedding vector of the user query, served from
+// the query cache when the same query was embedded before.
+func embedQuery(ctx context.Context, query string) ([]float64, error) {
+	if queryCacheDir != "" {
+		// A vector with another dimension than the index was made by
+		// another model under the same name
+		if vec := readCachedVector(queryCachePath(query)); vec != nil && (indexDims == 0 || len(vec) == indexDims) {
+			slog.Debug("using cached query embedding")
+			return vec, nil
+		}
+	}
+
+	embUserQuery, err := embed(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	if embUserQuery.TotalDuration > 0 {
+		slog.Debug("embedded query", "took", nanos(embUserQuery.TotalDuration), "load", nanos(embUserQuery.LoadDuration))
+	}
+
+	if len(embUserQuery.Embeddings) == 0 || len(embUserQuery.Embeddings[0]) == 0 {
+		return nil, errors.New("failed to create embedding for user query")
+	}
+
+	vec := embUserQuery.Embeddings[0]
+	if queryCacheDir != "" {
+		// The cache only saves time, failing to update it is not an error
+		data, err := json.Marshal(vec)
+		if err == nil {
+			err = os.MkdirAll(queryCacheDir, 0755)
+		}
+		if err == nil {
+			err = writeFileAtomic(queryCachePath(query), data, 0644)
+		}
+		if err != nil {
+			slog.Debug("failed to cache query embedding", "err", err)
+		}
+	}
+
+	return vec, nil
+}
+
+// nanos converts a duration reported by Ollama in nanoseconds into a
+// readable duration.
+func nanos(n int64) time.Duration {
+	return time.Duration(n).Round(time.Millisecond)
+}
+
+// search scores every file of the index against the query vector, blended
+// with keyword matches of the query text when hybridAlpha is set, and
+// returns up to n best results, best first. Scores are multiplied by the
+// weight of their source. Sources older than -since aren't scored.
+func search(index []EmbeddingFile, query string, queryVec []float64, n int) []ScoredResult {
+	terms := queryTerms(query)
+
+	files := &ix.Index{
+		Files:     recentFiles(index, since),
+		ScoreMode: scoreMode,
+		MinScore:  minScore,
+		Metric:    metric,
+		IVF:       annIndex,
+		Probes:    annProbes,
+		PerChunk:  retrievalUnit == "chunk",
+		Rescore: func(f EmbeddingFile, score func(i int) float64) func(i int) float64 {
+			if hybridAlpha > 0 {
+				score = hybridScore(f, terms, score)
+			}
+			if w := sourceWeightOf(f.Source); w != 1 {
+				unweighted := score
+				score = func(i int) float64 {
+					return unweighted(i) * w
+				}
+			}
+			if verboseLevel < 2 {
+				return score
+			}
+			return func(i int) float64 {
+				s := score(i)
+				slog.Debug("scored chunk", "path", f.Source, "chunk", f.ChunkPosition(i), "score", s)
+				return s
+			}
+		},
+	}
+
+	return files.Search(queryVec, n)
+}
+
+// loadContext returns the text of a scored result to be used as LLM context.
+// Depending on contextMode it is either the best matching chunk, re-chunked
+// from the source with the stored chunk size, or the whole source file.
+// The best chunk comes with contextWindow chunks before and after it.
+func loadContext(r ScoredResult) (string, error) {
+	if contextMode == "file" || r.ChunkSize <= 0 {
+		return readText(r.Path)
+	}
+
+	// The stored chunk text saves reading and chunking the source again
+	if r.Text != "" && contextWindow == 0 {
+		return r.Text, nil
+	}
+
+	chunks, err := chunkFile(r.Path, r.ChunkSize, r.ChunkStrategy)
+	if err != nil {
+		return "", err
+	}
+
+	if r.Chunk >= len(chunks) {
+		return "", fmt.Errorf("chunk %d not found in %s, source changed since it was embedded", r.Chunk, r.Path)
+	}
+
+	// Surrounding chunks keep thoughts cut at chunk boundaries whole
+	start := max(0, r.Chunk-contextWindow)
+	end := min(len(chunks), r.Chunk+contextWindow+1)
+
+	return strings.Join(chunks[start:end], ""), nil
+}
+
+// contextSection is the text of a single result used as LLM context.
+type contextSection struct {
+	Path string
+	Text string
+}
+
+// buildContext concatenates the text of the selected results into context
+// to prepend to the LLM prompt.
+func buildContext(results []ScoredResult) string {
+	context := ""
+	for _, s := range contextSections(results) {
+		context += s.Text + "\n"
+	}
+	return context
+}
+
+// contextSections returns the text of every selected result to be used as
+// context. With maxContextWords set the text is cut to that many words in
+// total, results are best first so the weakest text is dropped.
+func contextSections(results []ScoredResult) []contextSection {
+	sections := []contextSection{}
+	words, dropped := 0, 0
+	loaded := map[string]bool{}
+	for _, v := range results {
+		slog.Debug("selected file", "path", v.Path, "chunk", v.Chunk, "score", v.Score)
+
+		// Several chunks of a file may be selected, its whole text is
+		// only needed once
+		if contextMode == "file" {
+			if loaded[v.Path] {
+				continue
+			}
+			loaded[v.Path] = true
+		}
+
+		text, err := loadContext(v)
+		if err != nil {
+			slog.Warn("failed to load context", "err", err)
+			continue
+		}
+
+		if maxContextWords > 0 {
+			fields := strings.Fields(text)
+			if words+len(fields) > maxContextWords {
+				keep := max(0, maxContextWords-words)
+				dropped += len(fields) - keep
+				if keep == 0 {
+					continue
+				}
+				text = strings.Join(fields[:keep], " ")
+				fields = fields[:keep]
+			}
+			words += len(fields)
+		}
+
+		sections = append(sections, contextSection{Path: v.Path, Text: text})
+	}
+
+	if maxContextWords > 0 {
+		slog.Debug("built context", "words", words, "dropped", dropped)
+	}
+
+	return sections
+}
+
+// printContext prints the context sections, each preceded by a line naming
+// its source when separators is set.
+func printContext(sections []contextSection, separators bool) {
+	for _, s := range sections {
+		if separators {
+			fmt.Printf("--- source: %s ---\n", s.Path)
+		}
+		fmt.Println(s.Text)
+	}
+}
+
+// defaultPromptTemplate is used unless CCRAG_PROMPT_TEMPLATE or
+// CCRAG_PROMPT_FILE provide a different one.
+const defaultPromptTemplate = `Use the below information provided in org-mode markdown to answer the subsequent question. Do not offer any helpful advice! If can not be derived from provided Information use your best take to answer the question. 
+Information:
+{{.Context}}
+{{if .History}}
+Previous conversation:
+{{.History}}
+{{end}}
+Question: {{.Question}}`
+
+// codePromptTemplate replaces the default template when most of the
+// context comes from source code.
+const codePromptTemplate = `You are a programming assistant. Use the below source code to answer the subsequent question. Refer to functions and types by name and answer with code where it helps.
+Code:
+{{.Context}}
+{{if .History}}
+Previous conversation:
+{{.History}}
+{{end}}
+Question: {{.Question}}`
+
+// builtinPrompts are the prompt templates available by name without a
+// file in the prompt directory.
+var builtinPrompts = map[string]string{
+	"default": defaultPromptTemplate,
+	"code":    codePromptTemplate,
+}
+
+// codeExtensions are the extensions of source code files.
+var codeExtensions = map[string]bool{
+	".go": true, ".py": true, ".js": true, ".ts": true, ".rs": true,
+	".c": true, ".h": true, ".cpp": true, ".java": true, ".rb": true,
+	".sh": true, ".lua": true, ".el": true, ".swift": true, ".kt": true,
+}
+
+// promptDir holds named prompt templates as <name>.tmpl files.
+var promptDir string
+
+// codePrompt is used for context that is mostly source code when the
+// prompt is picked automatically, nil when it isn't.
+var codePrompt *template.Template
+
+type promptData struct {
+	Context  string
+	Question string
+	// History holds the previous questions and answers of the session
+	History string
+}
+
+// loadPromptTemplate parses the prompt template from CCRAG_PROMPT_TEMPLATE,
+// the file in CCRAG_PROMPT_FILE or falls back to the default one.
+func loadPromptTemplate() (*template.Template, error) {
+	text := defaultPromptTemplate
+	if promptTemplateText != "" {
+		text = promptTemplateText
+	} else if promptFile != "" {
+		data, err := os.ReadFile(promptFile)
+		if err != nil {
+			return nil, err
+		}
+		text = string(data)
+	}
+
+	return template.New("prompt").Parse(text)
+}
+
+// loadNamedPrompt parses the prompt template called name, read from
+// <name>.tmpl in the prompt directory or else one of the built-in ones.
+func loadNamedPrompt(name string) (*template.Template, error) {
+	text, ok := builtinPrompts[name]
+	data, err := os.ReadFile(filepath.Join(promptDir, name+".tmpl"))
+	if err == nil {
+		text, ok = string(data), true
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("unknown prompt %q, add it as %s", name, filepath.Join(promptDir, name+".tmpl"))
+	}
+	return template.New(name).Parse(text)
+}
+
+// promptFor returns the template to answer from the given sources with,
+// the code prompt when it is picked automatically and most of the sources
+// are source code files.
+func promptFor(sources []ScoredResult) *template.Template {
+	if codePrompt == nil {
+		return promptTemplate
+	}
+
+	code := 0
+	for _, s := range sources {
+		if codeExtensions[strings.ToLower(filepath.Ext(s.Path))] {
+			code++
+		}
+	}
+	if code*2 > len(sources) {
+		slog.Debug("using code prompt", "code_files", code, "files", len(sources))
+		return codePrompt
+	}
+	return promptTemplate
+}
+
+// buildPrompt makes the LLM prompt with the context of the notes and the
+// history of the conversation, if any, prepended to the question. The
+// template depends on the sources the context comes from.
+func buildPrompt(context string, question string, history string, sources []ScoredResult) (string, error) {
+	var prompt strings.Builder
+	if err := promptFor(sources).Execute(&prompt, promptData{Context: context, Question: question, History: history}); err != nil {
+		return "", err
+	}
+	return prompt.String(), nil
+}
+
+// runQuery searches the index for the query, unless context files are
+// given, and prints either the best matching files or the LLM answer based
+// on them.
+func runQuery(ctx context.Context, index []EmbeddingFile, query string, opts queryOptions) error {
+	var selectedScores []ScoredResult
+	var err error
+	if len(opts.contextFiles) > 0 {
+		// The files are known to be relevant, use all of them as a whole
+		for _, p := range opts.contextFiles {
+			selectedScores = append(selectedScores, ScoredResult{Score: 1, Path: p})
+		}
+	} else {
+		queryVec, err := embedQuery(ctx, query)
+		if err != nil {
+			return err
+		}
+
+		selectedScores = retrieve(ctx, index, query, queryVec, maxResults)
+	}
+
+	// JSON output already carries the score and best chunk of every result
+	explain := opts.explain && !opts.json && !opts.jsonl
+
+	// Print best matches only
+	if opts.similarityOnly {
+		if opts.jsonl {
+			err = printJSONLines(query, selectedScores)
+		} else if opts.json {
+			err = printJSON(selectedScores)
+		} else if explain {
+			printExplanation(selectedScores)
+		} else {
+			for _, v := range selectedScores {
+				if opts.scores {
+					fmt.Printf("%f\t%s\n", v.Score, v.Path)
+				} else {
+					fmt.Println(v.Path)
+				}
+			}
+		}
+		if err == nil && len(selectedScores) == 0 {
+			err = errNoResults
+		}
+		return err
+	}
+
+	// Without context the answer would not be based on the notes at all
+	if len(selectedScores) == 0 {
+		return errNoResults
+	}
+
+	if explain {
+		printExplanation(selectedScores)
+		fmt.Println()
+	}
+
+	// The context is the output, there's nothing to generate
+	if opts.contextOnly {
+		printContext(contextSections(selectedScores), opts.separators)
+		return nil
+	}
+
+	var sess session
+	if opts.sessionFile != "" {
+		if sess, err = loadSession(opts.sessionFile); err != nil {
+			return fmt.Errorf("failed to load session, %w", err)
+		}
+	}
+
+	prompt, err := buildPrompt(buildContext(selectedScores), query, sess.history(), selectedScores)
+	if err != nil {
+		return err
+	}
+
+	// Print the prompt exactly as it would be sent instead of generating
+	if opts.showPrompt {
+		fmt.Println(prompt)
+		return nil
+	}
+
+	var out io.Writer
+	if !opts.noStream && !opts.json && !opts.jsonl {
+		out = os.Stdout
+	}
+
+	ollamaResp, err := generate(ctx, prompt, out)
+	if err != nil {
+		return err
+	}
+
+	if ollamaResp.TotalDuration > 0 {
+		slog.Debug("generated answer", "took", nanos(ollamaResp.TotalDuration), "load", nanos(ollamaResp.LoadDuration),
+			"prompt_eval", nanos(ollamaResp.PromptEvalDuration), "prompt_tokens", ollamaResp.PromptEvalCount,
+			"eval", nanos(ollamaResp.EvalDuration), "tokens", ollamaResp.EvalCount)
+	}
+
+	if opts.sessionFile != "" {
+		// The answer was already given, a failure only loses the history
+		if err := sess.add(opts.sessionFile, sessionTurn{Question: query, Answer: ollamaResp.Response}); err != nil {
+			slog.Warn("failed to save session", "err", err)
+		}
+	}
+
+	if opts.jsonl {
+		return json.NewEncoder(os.Stdout).Encode(queryResponse{
+			Query:    query,
+			Response: ollamaResp.Response,
+			Sources:  selectedScores,
+		})
+	}
+
+	if opts.json {
+		return printJSON(queryResponse{
+			Response: ollamaResp.Response,
+			Sources:  selectedScores,
+		})
+	}
+
+	if opts.noStream {
+		fmt.Println(ollamaResp.Response)
+	} else {
+		fmt.Println()
+	}
+
+	if opts.cite {
+		fmt.Println()
+		fmt.Println("Sources:")
+		for _, v := range selectedScores {
+			fmt.Printf("%f\t%s\n", v.Score, v.Path)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestLoadIndexQuantized(t *testing.T) {
+	prevStore, prevQuantize, prevBackend := store, quantize, backendName
+	t.Cleanup(func() { store, quantize, backendName = prevStore, prevQuantize, prevBackend })
+
+	store = fileStore{dir: t.TempDir(), format: "json", ext: "json", naming: "fullpath-hash"}
+	backendName = "offline"
+
+	files := map[string][][]float64{
+		"/notes/a.txt": {{1, 0, 0}, {0, 1, 0}},
+		"/notes/b.txt": {{0, 0, 1}},
+	}
+	for source, embeddings := range files {
+		f := EmbeddingFile{Source: source, Embeddings: embeddings, Model: offlineModel}
+		// Collections embedded with CCRAG_QUANTIZE=int8 are stored quantized
+		if source == "/notes/b.txt" {
+			f = f.Quantize()
+		}
+		if err := store.Put(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	quantize = "int8"
+	index, err := loadIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(index) != len(files) {
+		t.Fatalf("loaded %d files, want %d", len(index), len(files))
+	}
+	for _, f := range index {
+		if f.Quantized == nil {
+			t.Errorf("%s was not quantized", f.Source)
+		}
+	}
+	if indexDims != 3 {
+		t.Errorf("index dimension is %d, want 3", indexDims)
+	}
+}
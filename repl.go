@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+)
+
+const replHelp = `Commands:
+  :n <count>      number of files used as context
+  :model <name>   LLM model used to answer
+  :cite           toggle printing the sources after the answer
+  :help           print this help
+  :quit           exit, same as EOF`
+
+// repl answers queries read line by line from in until EOF or :quit,
+// keeping the index loaded between them. Lines starting with a colon are
+// commands changing the settings for the following queries.
+func repl(ctx context.Context, index []EmbeddingFile, in io.Reader, opts queryOptions) error {
+	scanner := bufio.NewScanner(in)
+	fmt.Printf("Loaded %d embedded files, type :help for commands\n", len(index))
+
+	for {
+		fmt.Print("> ")
+		if !scanner.Scan() {
+			fmt.Println()
+			break
+		}
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		if !strings.HasPrefix(line, ":") {
+			// Ctrl-C abandons the answer being generated, at the prompt
+			// it exits
+			queryCtx, stop := signal.NotifyContext(ctx, os.Interrupt)
+			err := runQuery(queryCtx, index, line, opts)
+			interrupted := queryCtx.Err() != nil
+			stop()
+
+			if interrupted {
+				fmt.Println()
+			} else if errors.Is(err, errNoResults) {
+				fmt.Println(err)
+			} else if err != nil {
+				slog.Error("query failed", "err", err)
+			}
+			continue
+		}
+
+		cmd, arg, _ := strings.Cut(line[1:], " ")
+		arg = strings.TrimSpace(arg)
+		switch cmd {
+		case "q", "quit", "exit":
+			return nil
+		case "n":
+			n, err := strconv.Atoi(arg)
+			if err != nil || n < 1 {
+				slog.Warn("expected a positive number", "got", arg)
+				continue
+			}
+			maxResults = n
+		case "model":
+			if arg == "" {
+				fmt.Println(llmModel)
+				continue
+			}
+			llmModel = arg
+		case "cite":
+			opts.cite = !opts.cite
+			if opts.cite {
+				fmt.Println("Citations on")
+			} else {
+				fmt.Println("Citations off")
+			}
+		case "help":
+			fmt.Println(replHelp)
+		default:
+			slog.Warn("unknown command, type :help for commands", "command", cmd)
+		}
+	}
+
+	return scanner.Err()
+}
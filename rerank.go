@@ -0,0 +1,79 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strconv"
+)
+
+// rerankPrompt asks the LLM to rate the relevance of a passage to the
+// question, formatted with the question and the passage.
+const rerankPrompt = `Rate how relevant the passage is to answering the question on a scale from 0 to 10. Reply with the number only.
+
+Question: %s
+
+Passage:
+%s`
+
+var ratingNumber = regexp.MustCompile(`\d+(\.\d+)?`)
+
+// retrieve returns up to n files of the index best matching the query.
+// With rerank set the vector search only picks rerankCandidates candidates
+// which are then ordered by the LLM.
+func retrieve(ctx context.Context, index []EmbeddingFile, query string, queryVec []float64, n int) []ScoredResult {
+	if !rerank {
+		return search(index, query, queryVec, n)
+	}
+
+	candidates := search(index, query, queryVec, max(n, rerankCandidates))
+	return rerankResults(ctx, query, candidates, n)
+}
+
+// rerankResults scores every candidate by the relevance the LLM rates its
+// text with, from 0 to 1, and returns the n best. Candidates that can't be
+// rated score 0, ties keep their vector search order.
+func rerankResults(ctx context.Context, query string, candidates []ScoredResult, n int) []ScoredResult {
+	for i, r := range candidates {
+		score, err := rateRelevance(ctx, query, r)
+		if err != nil {
+			slog.Warn("failed to rerank result", "path", r.Path, "err", err)
+		}
+		slog.Debug("reranked file", "path", r.Path, "score", score, "vector_score", r.Score)
+		candidates[i].Score = score
+	}
+
+	slices.SortStableFunc(candidates, func(a, b ScoredResult) int {
+		return cmp.Compare(b.Score, a.Score)
+	})
+
+	return candidates[:min(n, len(candidates))]
+}
+
+// rateRelevance asks the LLM how relevant the context of the result is to
+// the query.
+func rateRelevance(ctx context.Context, query string, r ScoredResult) (float64, error) {
+	text, err := loadContext(r)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := generate(ctx, fmt.Sprintf(rerankPrompt, query, text), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	rating := ratingNumber.FindString(resp.Response)
+	if rating == "" {
+		return 0, fmt.Errorf("no rating in response %q", resp.Response)
+	}
+
+	score, err := strconv.ParseFloat(rating, 64)
+	if err != nil {
+		return 0, err
+	}
+	return min(score, 10) / 10, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// serverShutdownTimeout is how long requests being answered may take to
+// finish when the server is shut down.
+const serverShutdownTimeout = 10 * time.Second
+
+type generateRequest struct {
+	Query string `json:"query"`
+	N     int    `json:"n"`
+}
+
+// indexServer answers queries over HTTP against an index loaded once at
+// startup.
+type indexServer struct {
+	index []EmbeddingFile
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("failed to write response", "err", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// handleSearch serves GET /search?q=<query>&n=<count> with the best
+// matching files. With format=jsonl every file is written as a JSON line
+// of its own instead of a single array.
+func (s *indexServer) handleSearch(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query().Get("q")
+	if query == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("missing q parameter"))
+		return
+	}
+
+	n := maxResults
+	if v := r.URL.Query().Get("n"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n < 1 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid n parameter %q", v))
+			return
+		}
+	}
+
+	queryVec, err := embedQuery(r.Context(), query)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+
+	results := retrieve(r.Context(), s.index, query, queryVec, n)
+	if r.URL.Query().Get("format") != "jsonl" {
+		writeJSON(w, http.StatusOK, results)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	encoder := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	for _, res := range results {
+		if err := encoder.Encode(resultLine{Query: query, ScoredResult: res}); err != nil {
+			slog.Warn("failed to write response", "err", err)
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// handleGenerate serves POST /generate with a JSON generateRequest body
+// and answers with the LLM response and the sources it was based on.
+func (s *indexServer) handleGenerate(w http.ResponseWriter, r *http.Request) {
+	var req generateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if req.Query == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("missing query"))
+		return
+	}
+
+	if req.N < 1 {
+		req.N = maxResults
+	}
+
+	queryVec, err := embedQuery(r.Context(), req.Query)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+
+	selected := retrieve(r.Context(), s.index, req.Query, queryVec, req.N)
+	prompt, err := buildPrompt(buildContext(selected), req.Query, "", selected)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	resp, err := generate(r.Context(), prompt, nil)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, queryResponse{
+		Response: resp.Response,
+		Sources:  selected,
+	})
+}
+
+// serve exposes the index over HTTP on addr until the server fails or ctx
+// is canceled. Requests being answered are given serverShutdownTimeout to
+// finish, their requests to the backend are canceled after that.
+func serve(ctx context.Context, addr string, index []EmbeddingFile) error {
+	s := &indexServer{index: index}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /search", s.handleSearch)
+	mux.HandleFunc("POST /generate", s.handleGenerate)
+
+	// Handlers get a context canceled at shutdown
+	baseCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := &http.Server{
+		Addr:        addr,
+		Handler:     mux,
+		BaseContext: func(net.Listener) context.Context { return baseCtx },
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("shutting down")
+	shutdownCtx, stop := context.WithTimeout(context.Background(), serverShutdownTimeout)
+	defer stop()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		cancel()
+		return server.Close()
+	}
+	return nil
+}
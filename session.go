@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"strings"
+)
+
+// sessionTurns is the number of previous questions and answers kept in a
+// session, older ones are dropped so the prompt doesn't grow unbounded.
+const sessionTurns = 5
+
+// sessionTurn is a question along with the answer it got.
+type sessionTurn struct {
+	Question string `json:"question"`
+	Answer   string `json:"answer"`
+}
+
+// session is the conversation so far, kept in the CCRAG_SESSION file
+// between runs so follow-up questions can refer to previous answers.
+type session struct {
+	Turns []sessionTurn `json:"turns"`
+}
+
+// loadSession reads the session from path, a missing file is an empty
+// session.
+func loadSession(path string) (session, error) {
+	var s session
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return s, err
+	}
+
+	err = json.Unmarshal(data, &s)
+	return s, err
+}
+
+// add records a turn, keeping only the last sessionTurns ones, and writes
+// the session to path.
+func (s session) add(path string, turn sessionTurn) error {
+	s.Turns = append(s.Turns, turn)
+	s.Turns = s.Turns[max(0, len(s.Turns)-sessionTurns):]
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, 0644)
+}
+
+// history formats the previous turns to be included in the prompt.
+func (s session) history() string {
+	var b strings.Builder
+	for _, t := range s.Turns {
+		b.WriteString("Question: " + t.Question + "\n")
+		b.WriteString("Answer: " + t.Answer + "\n")
+	}
+	return b.String()
+}
+
+// resetSession deletes the session file so the next question starts a new
+// conversation.
+func resetSession(path string) error {
+	err := os.Remove(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
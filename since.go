@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sinceFilter restricts queries to sources modified recently, either within
+// age of the query or after date.
+type sinceFilter struct {
+	age  time.Duration
+	date time.Time
+}
+
+// since is set by the -since flag, the zero value doesn't filter anything.
+var since sinceFilter
+
+// sinceDateLayouts are the date formats accepted by -since.
+var sinceDateLayouts = []string{time.RFC3339, "2006-01-02T15:04", "2006-01-02"}
+
+// parseSince parses a duration like 36h, 7d or 2w, days and weeks on top of
+// the units of time.ParseDuration, or a date like 2024-05-01 in local time.
+func parseSince(s string) (sinceFilter, error) {
+	if n, ok := strings.CutSuffix(s, "d"); ok {
+		if days, err := strconv.Atoi(n); err == nil && days > 0 {
+			return sinceFilter{age: time.Duration(days) * 24 * time.Hour}, nil
+		}
+	}
+	if n, ok := strings.CutSuffix(s, "w"); ok {
+		if weeks, err := strconv.Atoi(n); err == nil && weeks > 0 {
+			return sinceFilter{age: time.Duration(weeks) * 7 * 24 * time.Hour}, nil
+		}
+	}
+	if age, err := time.ParseDuration(s); err == nil && age > 0 {
+		return sinceFilter{age: age}, nil
+	}
+
+	for _, layout := range sinceDateLayouts {
+		if date, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return sinceFilter{date: date}, nil
+		}
+	}
+	return sinceFilter{}, fmt.Errorf("%q is neither a positive duration like 7d nor a date like 2006-01-02", s)
+}
+
+// cutoff returns the modification time sources must be newer than, zero
+// when there is no filter. Ages are relative to now so long running modes
+// keep a moving window.
+func (f sinceFilter) cutoff() time.Time {
+	if f.age > 0 {
+		return time.Now().Add(-f.age)
+	}
+	return f.date
+}
+
+// recentFiles returns the files of the index whose source was modified after
+// the cutoff. Files embedded before modification times were recorded are
+// left out since their age is unknown.
+func recentFiles(index []EmbeddingFile, f sinceFilter) []EmbeddingFile {
+	cutoff := f.cutoff()
+	if cutoff.IsZero() {
+		return index
+	}
+
+	recent := []EmbeddingFile{}
+	unknown := 0
+	for _, file := range index {
+		if file.SourceModTime.IsZero() {
+			unknown++
+			continue
+		}
+		if file.SourceModTime.After(cutoff) {
+			recent = append(recent, file)
+		}
+	}
+
+	slog.Debug("filtered by modification time", "since", cutoff.Format(time.RFC3339), "files", len(recent), "older", len(index)-len(recent)-unknown, "unknown", unknown)
+	return recent
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS embeddings (
+	source     TEXT    NOT NULL,
+	chunk      INTEGER NOT NULL,
+	chunk_size INTEGER NOT NULL,
+	model      TEXT    NOT NULL,
+	mod_time   INTEGER NOT NULL,
+	vector     BLOB    NOT NULL,
+	PRIMARY KEY (source, chunk)
+);
+CREATE TABLE IF NOT EXISTS empty_sources (
+	source TEXT NOT NULL PRIMARY KEY,
+	file   TEXT NOT NULL
+)`
+
+// sqliteStore keeps all embeddings in a single SQLite database with one row
+// per chunk, keyed by the chunk position in the source. Vectors are stored
+// as little-endian float64 blobs. Sources without any chunk are kept as
+// JSON in empty_sources so they are remembered too.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+// openSQLiteStore opens the database at path, creating it when missing. A
+// read-only store never writes to the database, a missing one is replaced
+// by an empty database in memory.
+func openSQLiteStore(path string, readOnly bool) (*sqliteStore, error) {
+	dsn := path
+	if readOnly {
+		dsn = "file:" + path + "?mode=ro"
+		if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+			dsn = ":memory:"
+		}
+	}
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	// Embed workers write concurrently, serialize them on a single
+	// connection instead of fighting over the database lock.
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, readOnlyError(path, readOnly, err)
+	}
+
+	// Columns added after the initial schema
+	for _, c := range [][2]string{
+		{"normalized", "INTEGER NOT NULL DEFAULT 0"},
+		{"chunk_strategy", "TEXT NOT NULL DEFAULT ''"},
+		{"text", "TEXT"},
+	} {
+		if err := ensureColumn(db, c[0], c[1]); err != nil {
+			db.Close()
+			return nil, readOnlyError(path, readOnly, err)
+		}
+	}
+
+	return &sqliteStore{db: db}, nil
+}
+
+// readOnlyError explains a failed schema update of a read-only database,
+// which happens when it was written by an older version.
+func readOnlyError(path string, readOnly bool, err error) error {
+	if !readOnly {
+		return err
+	}
+	return fmt.Errorf("%s needs an upgrade that a dry run can't do, run without -dry-run once: %w", path, err)
+}
+
+// ensureColumn adds the column to the embeddings table of databases created
+// before it existed.
+func ensureColumn(db *sql.DB, name string, decl string) error {
+	rows, err := db.Query(`SELECT name FROM pragma_table_info('embeddings')`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			return err
+		}
+		if column == name {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = db.Exec(`ALTER TABLE embeddings ADD COLUMN ` + name + ` ` + decl)
+	return err
+}
+
+func encodeVector(v []float64) []byte {
+	buf := make([]byte, 8*len(v))
+	for i, f := range v {
+		binary.LittleEndian.PutUint64(buf[8*i:], math.Float64bits(f))
+	}
+	return buf
+}
+
+func decodeVector(buf []byte) ([]float64, error) {
+	if len(buf)%8 != 0 {
+		return nil, fmt.Errorf("invalid vector blob of %d bytes", len(buf))
+	}
+
+	v := make([]float64, len(buf)/8)
+	for i := range v {
+		v[i] = math.Float64frombits(binary.LittleEndian.Uint64(buf[8*i:]))
+	}
+	return v, nil
+}
+
+func encodeModTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func decodeModTime(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+// query loads the embedding files returned by the given chunk query grouped
+// by source. Rows must be ordered by source and chunk. A chunk that can't
+// be decoded doesn't fail the query, the error is returned for its source
+// in decodeErrs.
+func (s *sqliteStore) query(q string, args ...any) ([]EmbeddingFile, map[string]error, error) {
+	rows, err := s.db.Query(q, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	files := []EmbeddingFile{}
+	decodeErrs := map[string]error{}
+	for rows.Next() {
+		var (
+			source, model    string
+			chunk, chunkSize int
+			chunkStrategy    string
+			modTime          int64
+			normalized       bool
+			blob             []byte
+			text             sql.NullString
+		)
+		if err := rows.Scan(&source, &chunk, &chunkSize, &chunkStrategy, &model, &modTime, &normalized, &blob, &text); err != nil {
+			return nil, nil, err
+		}
+
+		if len(files) == 0 || files[len(files)-1].Source != source {
+			files = append(files, EmbeddingFile{
+				ChunkSize:     chunkSize,
+				ChunkStrategy: chunkStrategy,
+				Source:        source,
+				Model:         model,
+				SourceModTime: decodeModTime(modTime),
+				Normalized:    normalized,
+			})
+		}
+		last := &files[len(files)-1]
+
+		vector, err := decodeVector(blob)
+		if err != nil {
+			if decodeErrs[source] == nil {
+				decodeErrs[source] = fmt.Errorf("%s chunk %d: %w", source, chunk, err)
+			}
+			continue
+		}
+		last.Embeddings = append(last.Embeddings, vector)
+		last.ChunkIndex = append(last.ChunkIndex, chunk)
+		if text.Valid {
+			last.Chunks = append(last.Chunks, text.String)
+		}
+	}
+
+	return files, decodeErrs, rows.Err()
+}
+
+func (s *sqliteStore) Get(source string) (EmbeddingFile, error) {
+	files, decodeErrs, err := s.query(`SELECT source, chunk, chunk_size, chunk_strategy, model, mod_time, normalized, vector, text
+		FROM embeddings WHERE source = ? ORDER BY chunk`, source)
+	if err != nil {
+		return EmbeddingFile{}, err
+	}
+	if err := decodeErrs[source]; err != nil {
+		return EmbeddingFile{}, err
+	}
+
+	if len(files) == 0 {
+		files, err = s.emptySources(`WHERE source = ?`, source)
+		if err != nil {
+			return EmbeddingFile{}, err
+		}
+	}
+	if len(files) == 0 {
+		return EmbeddingFile{}, fmt.Errorf("%s: %w", source, fs.ErrNotExist)
+	}
+
+	return files[0], nil
+}
+
+// emptySources loads the sources stored without any chunk matching the
+// condition.
+func (s *sqliteStore) emptySources(cond string, args ...any) ([]EmbeddingFile, error) {
+	rows, err := s.db.Query(`SELECT file FROM empty_sources `+cond, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := []EmbeddingFile{}
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+
+		var f EmbeddingFile
+		if err := json.Unmarshal([]byte(data), &f); err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+
+	return files, rows.Err()
+}
+
+func (s *sqliteStore) Put(f EmbeddingFile) error {
+	// Vectors are always stored as floats
+	f = f.Dequantize()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"embeddings", "empty_sources"} {
+		if _, err := tx.Exec(`DELETE FROM `+table+` WHERE source = ?`, f.Source); err != nil {
+			return err
+		}
+	}
+
+	if len(f.Embeddings) == 0 {
+		data, err := json.Marshal(f)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO empty_sources (source, file) VALUES (?, ?)`, f.Source, string(data)); err != nil {
+			return err
+		}
+	}
+
+	for i, emb := range f.Embeddings {
+		// Chunk text is NULL unless it was stored
+		var text sql.NullString
+		if len(f.Chunks) == len(f.Embeddings) {
+			text = sql.NullString{String: f.Chunks[i], Valid: true}
+		}
+
+		_, err := tx.Exec(`INSERT INTO embeddings (source, chunk, chunk_size, chunk_strategy, model, mod_time, normalized, vector, text)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			f.Source, f.ChunkPosition(i), f.ChunkSize, f.ChunkStrategy, f.Model, encodeModTime(f.SourceModTime), f.Normalized, encodeVector(emb), text)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqliteStore) Delete(source string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	removed := int64(0)
+	for _, table := range []string{"embeddings", "empty_sources"} {
+		res, err := tx.Exec(`DELETE FROM `+table+` WHERE source = ?`, source)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err == nil {
+			removed += n
+		}
+	}
+
+	if removed == 0 {
+		return fmt.Errorf("%s: %w", source, fs.ErrNotExist)
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqliteStore) Walk(fn func(name string, f EmbeddingFile, err error) error) error {
+	// Load everything up front so fn is free to modify the store
+	files, decodeErrs, err := s.query(`SELECT source, chunk, chunk_size, chunk_strategy, model, mod_time, normalized, vector, text
+		FROM embeddings ORDER BY source, chunk`)
+	if err != nil {
+		return err
+	}
+
+	empty, err := s.emptySources("")
+	if err != nil {
+		return err
+	}
+	files = append(files, empty...)
+	slices.SortFunc(files, func(a, b EmbeddingFile) int {
+		return strings.Compare(a.Source, b.Source)
+	})
+
+	// Like an unreadable embedding file, a source with a corrupt chunk is
+	// passed to fn with its error instead of failing the whole walk
+	for _, f := range files {
+		if err := fn(f.Source, f, decodeErrs[f.Source]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
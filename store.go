@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+
+	cc "github.com/kif11/cclib"
+	ix "github.com/kif11/rag/pkg/index"
+)
+
+// Store persists embedding files keyed by their source path.
+type Store interface {
+	// Get returns the embedding file stored for source. The error satisfies
+	// errors.Is(err, fs.ErrNotExist) when nothing is stored for it.
+	Get(source string) (EmbeddingFile, error)
+	// Put stores f, replacing anything previously stored for f.Source.
+	Put(f EmbeddingFile) error
+	// Delete removes the embedding file stored for source.
+	Delete(source string) error
+	// Walk calls fn for every stored entry. The name identifies the entry
+	// inside the store and err is set when the entry could not be loaded.
+	Walk(fn func(name string, f EmbeddingFile, err error) error) error
+	Close() error
+}
+
+// embedExtensions lists the extensions of all files fileStore reads, every
+// format either plain or gzip compressed.
+func embedExtensions() []string {
+	return ix.Extensions()
+}
+
+// newStore opens the store of the given kind inside dir. A read-only store
+// creates nothing, it is empty when dir doesn't exist yet.
+func newStore(kind string, dir string, readOnly bool) (Store, error) {
+	switch kind {
+	case "file":
+		if !slices.Contains(ix.Formats, embedFormat) {
+			return nil, fmt.Errorf("unknown embedding format %q, expected json or bin", embedFormat)
+		}
+		if !slices.Contains(namings, naming) {
+			return nil, fmt.Errorf("unknown CCRAG_NAMING %q, expected basename, fullpath-hash or mirror", naming)
+		}
+		ext := embedFormat
+		if embedCompress {
+			ext += ".gz"
+		}
+		return fileStore{dir: dir, format: embedFormat, ext: ext, naming: naming}, nil
+	case "sqlite":
+		return openSQLiteStore(filepath.Join(dir, "embeddings.db"), readOnly)
+	default:
+		return nil, fmt.Errorf("unknown store %q, expected file or sqlite", kind)
+	}
+}
+
+// migrateLegacyEmbeddings moves embedding files and the sqlite database
+// written directly into root, before collections existed, into the default
+// collection directory. Files the default collection already has are left
+// in place.
+func migrateLegacyEmbeddings(root string, defaultDir string) error {
+	patterns := []string{"embeddings.db", "embeddings.db-wal", "embeddings.db-shm"}
+	for _, ext := range embedExtensions() {
+		patterns = append(patterns, "*."+ext)
+	}
+
+	moved := 0
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(filepath.Join(root, pattern))
+		if err != nil {
+			return err
+		}
+
+		for _, path := range matches {
+			// Collections are directories and may be named like a file
+			if info, err := os.Stat(path); err != nil || info.IsDir() {
+				continue
+			}
+
+			if err := os.MkdirAll(defaultDir, 0755); err != nil {
+				return err
+			}
+
+			dest := filepath.Join(defaultDir, filepath.Base(path))
+			if _, err := os.Stat(dest); err == nil {
+				slog.Warn("not moving embeddings, the default collection already has a file of the same name", "file", path)
+				continue
+			}
+			if err := os.Rename(path, dest); err != nil {
+				return err
+			}
+			moved++
+		}
+	}
+
+	if moved > 0 {
+		slog.Info("moved embeddings written before collections existed into the default collection", "files", moved, "dir", defaultDir)
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames
+// it into place, so an interrupted write never leaves a truncated file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func gzipData(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// namings lists the schemes embedding files of a fileStore are named by.
+var namings = []string{"fullpath-hash", "basename", "mirror"}
+
+// basenameMu guards writes of files named by the source file name alone,
+// so concurrent workers can't overwrite each other's sources.
+var basenameMu sync.Mutex
+
+// fileStore keeps every embedding file as a separate document in dir,
+// written in the given format with the given extension, which has a .gz
+// suffix when the files are compressed, and named by the given scheme.
+// Files of every known format are read, compressed or not.
+type fileStore struct {
+	dir    string
+	format string
+	ext    string
+	naming string
+}
+
+// name returns the embedding file of source under a naming scheme.
+// "fullpath-hash" starts with the source file name for readability followed
+// by a hash of the full source path, so sources with the same name in
+// different directories don't overwrite each other. "basename" is the
+// source file name alone, as files were named before the hash was added.
+// "mirror" recreates the directory structure of the source inside dir.
+func (s fileStore) name(naming string, source string, ext string) string {
+	switch naming {
+	case "basename":
+		return filepath.Join(s.dir, cc.FileName(source)+"."+ext)
+	case "mirror":
+		if abs, err := filepath.Abs(source); err == nil {
+			source = abs
+		}
+		source = strings.TrimPrefix(source, filepath.VolumeName(source))
+		return filepath.Join(s.dir, source+"."+ext)
+	default:
+		sum := sha256.Sum256([]byte(source))
+		return filepath.Join(s.dir, cc.FileName(source)+"-"+hex.EncodeToString(sum[:6])+"."+ext)
+	}
+}
+
+// trimNameHash returns name without the "-" and source path hash appended
+// by the fullpath-hash naming scheme, name itself when it has none.
+func trimNameHash(name string) string {
+	i := strings.LastIndex(name, "-")
+	if i < 0 || len(name)-i-1 != 12 {
+		return name
+	}
+	if _, err := hex.DecodeString(name[i+1:]); err != nil {
+		return name
+	}
+	return name[:i]
+}
+
+// path returns the embedding file of source under the naming scheme of the
+// store.
+func (s fileStore) path(source string, ext string) string {
+	return s.name(s.naming, source, ext)
+}
+
+func (s fileStore) Get(source string) (EmbeddingFile, error) {
+	embFile, err := ix.ReadFile(s.path(source, s.ext))
+	if err == nil && embFile.Source != source {
+		// Named by the source file name alone, it belongs to another source
+		err = fmt.Errorf("%s: %w", source, fs.ErrNotExist)
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return embFile, err
+	}
+
+	// Fall back to files written under another naming scheme, they are
+	// renamed the next time the source is embedded
+	for _, naming := range namings {
+		if naming == s.naming {
+			continue
+		}
+		other, otherErr := ix.ReadFile(s.name(naming, source, s.ext))
+		if otherErr == nil && other.Source == source {
+			return other, nil
+		}
+	}
+	return EmbeddingFile{}, err
+}
+
+// removeCopies removes the embedding files of source in every format and
+// under every naming scheme except the file keep and reports whether there
+// were any. A file named by the source file name alone may belong to
+// another source, so it is only removed after checking its source.
+func (s fileStore) removeCopies(source string, keep string) (bool, error) {
+	removed := false
+	for _, naming := range namings {
+		for _, ext := range embedExtensions() {
+			path := s.name(naming, source, ext)
+			if path == keep {
+				continue
+			}
+			if naming == "basename" {
+				embFile, err := ix.ReadFile(path)
+				if err != nil || embFile.Source != source {
+					continue
+				}
+			}
+
+			err := os.Remove(path)
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return removed, err
+			}
+			removed = true
+			s.removeEmptyDirs(filepath.Dir(path))
+		}
+	}
+	return removed, nil
+}
+
+// removeEmptyDirs removes dir and its parents up to the store directory
+// while they are empty, left behind by mirrored sources.
+func (s fileStore) removeEmptyDirs(dir string) {
+	for dir != s.dir && strings.HasPrefix(dir, s.dir) {
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+func (s fileStore) Put(f EmbeddingFile) error {
+	path := s.path(f.Source, s.ext)
+	if s.naming == "basename" {
+		basenameMu.Lock()
+		defer basenameMu.Unlock()
+		if other, err := ix.ReadFile(path); err == nil && other.Source != f.Source {
+			return fmt.Errorf("%s already holds the embeddings of %s, use CCRAG_NAMING=fullpath-hash to tell sources with the same name apart", path, other.Source)
+		}
+	}
+
+	var data []byte
+	var err error
+	if s.format == "bin" {
+		data, err = ix.EncodeBinary(f)
+	} else {
+		data, err = json.Marshal(f)
+	}
+	if err == nil && s.ext != s.format {
+		data, err = gzipData(data)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, data, 0644); err != nil {
+		return err
+	}
+
+	// Drop copies left behind in other formats or under other names so the
+	// source isn't scored twice
+	_, err = s.removeCopies(f.Source, path)
+
+	return err
+}
+
+func (s fileStore) Delete(source string) error {
+	removed, err := s.removeCopies(source, "")
+	if err != nil {
+		return err
+	}
+
+	if !removed {
+		return fmt.Errorf("%s: %w", source, fs.ErrNotExist)
+	}
+
+	return nil
+}
+
+func (s fileStore) Walk(fn func(name string, f EmbeddingFile, err error) error) error {
+	embedFiles, err := ix.FindFiles(s.dir)
+	if err != nil {
+		return err
+	}
+
+	// Read and decode the files in parallel, fn is still called from a
+	// single goroutine and in a stable order.
+	type result struct {
+		embFile EmbeddingFile
+		err     error
+	}
+	results := make([]result, len(embedFiles))
+
+	limiter := make(chan bool, runtime.NumCPU())
+	var wg sync.WaitGroup
+	for i, file := range embedFiles {
+		limiter <- true
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			defer func() { <-limiter }()
+
+			embFile, err := ix.ReadFile(file)
+			results[i] = result{embFile, err}
+		}()
+	}
+	wg.Wait()
+
+	for i, file := range embedFiles {
+		if err := fn(file, results[i].embFile, results[i].err); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s fileStore) Close() error {
+	return nil
+}
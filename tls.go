@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// tlsConfig returns the TLS settings for connections to the server, nil to
+// keep the defaults when none of them is set. A private CA is trusted on
+// top of the system ones, a client certificate is presented for mutual TLS.
+func tlsConfig() (*tls.Config, error) {
+	if caFile == "" && clientCert == "" && clientKey == "" && !tlsInsecure {
+		return nil, nil
+	}
+
+	config := &tls.Config{}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CCRAG_CA_FILE, %w", err)
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificates found in CCRAG_CA_FILE %s", caFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if (clientCert == "") != (clientKey == "") {
+		return nil, errors.New("CCRAG_CLIENT_CERT and CCRAG_CLIENT_KEY must be set together")
+	}
+	if clientCert != "" {
+		cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate, %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if tlsInsecure {
+		slog.Warn("CCRAG_TLS_INSECURE is set, server certificates are not verified")
+		config.InsecureSkipVerify = true
+	}
+
+	return config, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ignoreFileName lists glob patterns, one per line, of files and
+// directories to leave out when walking a directory root.
+const ignoreFileName = ".ccragignore"
+
+// readIgnoreFile returns the patterns from the ignore file in root, if any.
+func readIgnoreFile(root string) ([]string, error) {
+	f, err := os.Open(filepath.Join(root, ignoreFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	lines, err := readLines(f)
+	if err != nil {
+		return nil, err
+	}
+
+	patterns := []string{}
+	for _, l := range lines {
+		l = strings.TrimSpace(l)
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		patterns = append(patterns, strings.TrimSuffix(l, "/"))
+	}
+
+	return patterns, nil
+}
+
+// matchAny reports whether name matches any of the glob patterns.
+func matchAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := filepath.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// walkDir returns all files under root whose name matches one of the
+// include patterns. Hidden directories and anything matched by the
+// root's .ccragignore, by name or by path relative to root, are skipped.
+func walkDir(root string, include []string) ([]string, error) {
+	ignore, err := readIgnoreFile(root)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := []string{}
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if path == root {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			if strings.HasPrefix(d.Name(), ".") || matchAny(ignore, d.Name()) || matchAny(ignore, rel) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !d.Type().IsRegular() || matchAny(ignore, d.Name()) || matchAny(ignore, rel) {
+			return nil
+		}
+
+		if matchAny(include, d.Name()) {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+
+	return paths, err
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// How often watched directories are scanned and for how long a file must
+// stay unchanged before it is embedded again.
+const (
+	watchInterval = 2 * time.Second
+	watchDebounce = 3 * time.Second
+)
+
+// watcher polls the directories containing the watched sources and
+// re-embeds files after they change. Besides the known sources it picks
+// up new files in the same directories sharing one of their extensions.
+type watcher struct {
+	dirs    map[string]bool
+	exts    map[string]bool
+	seen    map[string]time.Time
+	pending map[string]time.Time
+	scanned bool
+}
+
+func newWatcher(paths []string) *watcher {
+	w := &watcher{
+		dirs:    map[string]bool{},
+		exts:    map[string]bool{},
+		seen:    map[string]time.Time{},
+		pending: map[string]time.Time{},
+	}
+
+	for _, p := range paths {
+		w.dirs[filepath.Dir(p)] = true
+		w.exts[filepath.Ext(p)] = true
+		// Every known file is checked once at startup, embedPath skips
+		// the ones that are already up to date.
+		w.pending[p] = time.Time{}
+	}
+
+	return w
+}
+
+// scan records files modified since the previous scan as pending.
+func (w *watcher) scan() {
+	now := time.Now()
+	for dir := range w.dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			slog.Warn("failed to read watched directory", "dir", dir, "err", err)
+			continue
+		}
+
+		for _, e := range entries {
+			if !e.Type().IsRegular() || !w.exts[filepath.Ext(e.Name())] {
+				continue
+			}
+
+			info, err := e.Info()
+			if err != nil {
+				continue
+			}
+
+			path := filepath.Join(dir, e.Name())
+			last, ok := w.seen[path]
+			w.seen[path] = info.ModTime()
+
+			// The first scan only records the current state, files that
+			// already existed are not embedded unless they are known sources.
+			if !w.scanned || (ok && info.ModTime().Equal(last)) {
+				continue
+			}
+
+			slog.Debug("changed", "path", path)
+			w.pending[path] = now
+		}
+	}
+	w.scanned = true
+}
+
+// flush embeds pending files that have not changed for the debounce period.
+func (w *watcher) flush(ctx context.Context) {
+	for path, changed := range w.pending {
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(changed) < watchDebounce {
+			continue
+		}
+		delete(w.pending, path)
+
+		// Keep the chunking settings a file was embedded with, they may
+		// come from a manifest
+		target := embedTarget{Path: path, ChunkSize: chunkSize, Strategy: chunkStrategy}
+		if f, err := store.Get(path); err == nil && f.ChunkSize > 0 {
+			target.ChunkSize, target.Strategy = f.ChunkSize, f.ChunkStrategy
+		}
+
+		err := embedPath(ctx, target)
+		if errors.Is(err, errUpToDate) || errors.Is(err, errSkipped) {
+			continue
+		}
+		if err != nil && ctx.Err() == nil {
+			slog.Error("failed to embed file", "err", err)
+			continue
+		}
+		if err != nil {
+			// Interrupted midway, the file is embedded at the next start
+			return
+		}
+		fmt.Printf("Embedded %s\n", path)
+	}
+}
+
+// watch keeps the index in sync with the given sources until ctx is
+// canceled.
+func watch(ctx context.Context, paths []string) {
+	w := newWatcher(paths)
+
+	for dir := range w.dirs {
+		slog.Debug("watching", "dir", dir)
+	}
+
+	for {
+		w.scan()
+		w.flush(ctx)
+
+		select {
+		case <-ctx.Done():
+			slog.Debug("stopped watching")
+			return
+		case <-time.After(watchInterval):
+		}
+	}
+}
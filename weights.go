@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// sourceWeight multiplies the scores of sources matching a glob pattern.
+type sourceWeight struct {
+	pattern string
+	weight  float64
+}
+
+// weights are read from CCRAG_WEIGHTS_FILE, sources matching none of them
+// keep their scores.
+var weights []sourceWeight
+
+// readWeightsFile reads lines of a glob pattern followed by a weight, such
+// as "**/curated/** 1.5". Blank lines and lines starting with # are
+// skipped. A missing file has no weights.
+func readWeightsFile(path string) ([]sourceWeight, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	lines, err := readLines(f)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed := []sourceWeight{}
+	for i, l := range lines {
+		l = strings.TrimSpace(l)
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+
+		fields := strings.Fields(l)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a pattern and a weight", path, i+1)
+		}
+		w, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil || w < 0 {
+			return nil, fmt.Errorf("%s:%d: invalid weight %q", path, i+1, fields[1])
+		}
+		if _, err := filepath.Match(fields[0], ""); err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid pattern %q, %w", path, i+1, fields[0], err)
+		}
+		parsed = append(parsed, sourceWeight{pattern: fields[0], weight: w})
+	}
+
+	return parsed, nil
+}
+
+// sourceWeightOf returns the weight of the first pattern matching the
+// source path or its file name, 1 when none does.
+func sourceWeightOf(source string) float64 {
+	for _, w := range weights {
+		if matchPath(w.pattern, source) || matchAny([]string{w.pattern}, filepath.Base(source)) {
+			return w.weight
+		}
+	}
+	return 1
+}
+
+// matchPath reports whether path matches the glob pattern element by
+// element. Unlike filepath.Match, a "**" element matches any number of
+// directories, so "**/curated/**" matches every file below a curated
+// directory at any depth.
+func matchPath(pattern, path string) bool {
+	return matchElems(strings.Split(filepath.ToSlash(pattern), "/"), strings.Split(filepath.ToSlash(path), "/"))
+}
+
+func matchElems(pattern, path []string) bool {
+	if len(pattern) == 0 {
+		return len(path) == 0
+	}
+
+	if pattern[0] == "**" {
+		for i := 0; i <= len(path); i++ {
+			if matchElems(pattern[1:], path[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(path) == 0 {
+		return false
+	}
+	if ok, _ := filepath.Match(pattern[0], path[0]); !ok {
+		return false
+	}
+	return matchElems(pattern[1:], path[1:])
+}